@@ -0,0 +1,34 @@
+package forjitree
+
+import (
+	"strings"
+)
+
+// Batch accumulates patches which are applied to the tree with a single Set
+type Batch struct {
+	patches []any
+}
+
+// Batch calls f to collect patches and applies them in order as sequential Set calls do: a deleted and added
+// again node gets a new object. Objects are synchronized, CreatedChildren and CreatedTree are called and watchers
+// and subscribers are notified only once, after all patches are applied. The tree is not locked while f runs.
+func (t *Tree) Batch(f func(b *Batch)) *SetResult {
+	b := &Batch{}
+	f(b)
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if len(b.patches) == 0 {
+		return newSetResult()
+	}
+	return t.setPatches(b.patches)
+}
+
+func (b *Batch) Set(data any) {
+	b.patches = append(b.patches, CloneValue(data))
+}
+
+func (b *Batch) SetPath(path string, value any) {
+	b.Set(MakePatchWithPath(strings.TrimPrefix(path, "/"), value, false))
+}
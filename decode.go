@@ -0,0 +1,384 @@
+package forjitree
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"time"
+)
+
+var (
+	durationType        = reflect.TypeOf(time.Duration(0))
+	timeType            = reflect.TypeOf(time.Time{})
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// Decode stores the tree value in the value pointed to by target. Maps fill structs (fields are bound the same way
+// as object fields, see FieldTag) and typed maps, slices fill typed slices and arrays, pointers are allocated as needed.
+// Strings are parsed into numbers, booleans, time.Duration, time.Time (RFC 3339) and encoding.TextUnmarshaler values.
+func Decode(value any, target any) error {
+	rv := reflect.ValueOf(target)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("target should be a non-nil pointer, got %T", target)
+	}
+	return decodeValue(rv.Elem(), value)
+}
+
+func decodeValue(dst reflect.Value, value any) error {
+	if value == nil {
+		dst.Set(reflect.Zero(dst.Type()))
+		return nil
+	}
+
+	dstType := dst.Type()
+	src := reflect.ValueOf(value)
+
+	if dstType.Kind() == reflect.Interface {
+		if !src.Type().Implements(dstType) {
+			return fmt.Errorf("cannot decode %T into %s", value, dstType)
+		}
+		dst.Set(src)
+		return nil
+	}
+
+	if dstType.Kind() == reflect.Pointer {
+		if src.Type().AssignableTo(dstType) {
+			dst.Set(src)
+			return nil
+		}
+		elem := reflect.New(dstType.Elem())
+		if err := decodeValue(elem.Elem(), value); err != nil {
+			return err
+		}
+		dst.Set(elem)
+		return nil
+	}
+
+	if s, isStr := value.(string); isStr && dstType != timeType && reflect.PointerTo(dstType).Implements(textUnmarshalerType) {
+		return dst.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+	}
+
+	if dstType == durationType {
+		return decodeDuration(dst, value)
+	}
+	if dstType == timeType {
+		return decodeTime(dst, value)
+	}
+
+	switch dstType.Kind() {
+	case reflect.Struct:
+		m, ok := value.(map[string]any)
+		if !ok {
+			break
+		}
+		return decodeStruct(dst, m)
+
+	case reflect.Map:
+		m, ok := value.(map[string]any)
+		if !ok {
+			break
+		}
+		result := reflect.MakeMapWithSize(dstType, len(m))
+		for k, v := range m {
+			key := reflect.New(dstType.Key()).Elem()
+			if err := decodeValue(key, k); err != nil {
+				return fmt.Errorf("key %s: %w", k, err)
+			}
+			elem := reflect.New(dstType.Elem()).Elem()
+			if err := decodeValue(elem, v); err != nil {
+				return fmt.Errorf("%s: %w", k, err)
+			}
+			result.SetMapIndex(key, elem)
+		}
+		dst.Set(result)
+		return nil
+
+	case reflect.Slice:
+		sl, ok := value.([]any)
+		if !ok {
+			break
+		}
+		result := reflect.MakeSlice(dstType, len(sl), len(sl))
+		for i, v := range sl {
+			if err := decodeValue(result.Index(i), v); err != nil {
+				return fmt.Errorf("%d: %w", i, err)
+			}
+		}
+		dst.Set(result)
+		return nil
+
+	case reflect.Array:
+		sl, ok := value.([]any)
+		if !ok {
+			break
+		}
+		if len(sl) > dst.Len() {
+			return fmt.Errorf("cannot decode %d items into %s", len(sl), dstType)
+		}
+		dst.Set(reflect.Zero(dstType))
+		for i, v := range sl {
+			if err := decodeValue(dst.Index(i), v); err != nil {
+				return fmt.Errorf("%d: %w", i, err)
+			}
+		}
+		return nil
+
+	case reflect.Bool:
+		switch v := value.(type) {
+		case bool:
+			dst.SetBool(v)
+			return nil
+		case string:
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return err
+			}
+			dst.SetBool(b)
+			return nil
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if s, isStr := value.(string); isStr {
+			i, err := strconv.ParseInt(s, 10, dstType.Bits())
+			if err != nil {
+				return err
+			}
+			dst.SetInt(i)
+			return nil
+		}
+		if f, isNumber := toFloat(value); isNumber {
+			if f != math.Trunc(f) || dst.OverflowInt(int64(f)) {
+				return fmt.Errorf("%v does not fit into %s", value, dstType)
+			}
+			dst.SetInt(int64(f))
+			return nil
+		}
+
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		if s, isStr := value.(string); isStr {
+			u, err := strconv.ParseUint(s, 10, dstType.Bits())
+			if err != nil {
+				return err
+			}
+			dst.SetUint(u)
+			return nil
+		}
+		if f, isNumber := toFloat(value); isNumber {
+			if f < 0 || f != math.Trunc(f) || dst.OverflowUint(uint64(f)) {
+				return fmt.Errorf("%v does not fit into %s", value, dstType)
+			}
+			dst.SetUint(uint64(f))
+			return nil
+		}
+
+	case reflect.Float32, reflect.Float64:
+		if s, isStr := value.(string); isStr {
+			f, err := strconv.ParseFloat(s, dstType.Bits())
+			if err != nil {
+				return err
+			}
+			dst.SetFloat(f)
+			return nil
+		}
+		if f, isNumber := toFloat(value); isNumber {
+			dst.SetFloat(f)
+			return nil
+		}
+
+	case reflect.String:
+		if src.Kind() == reflect.String {
+			dst.SetString(src.String())
+			return nil
+		}
+	}
+
+	if src.Type().AssignableTo(dstType) {
+		dst.Set(src)
+		return nil
+	}
+	return fmt.Errorf("cannot decode %T into %s", value, dstType)
+}
+
+// decodeStruct resets the struct and fills it with the map values, absent keys get the defaults from the tags
+func decodeStruct(dst reflect.Value, m map[string]any) error {
+	fields := getStructFields(dst.Type())
+	dst.Set(reflect.Zero(dst.Type()))
+
+	present := map[*fieldInfo]bool{}
+	for k, v := range m {
+		fi := fields.lookup(k)
+		if fi == nil {
+			fields.setExtra(dst, k, v)
+			continue
+		}
+		if fi.omitEmpty && isEmptyValue(v) {
+			continue
+		}
+		present[fi] = true
+		if err := decodeValue(dst.FieldByIndex(fi.index), v); err != nil {
+			return fmt.Errorf("%s: %w", k, err)
+		}
+	}
+
+	for _, fi := range fields.list {
+		if present[fi] {
+			continue
+		}
+		if fi.hasDefault {
+			if err := decodeDefault(dst.FieldByIndex(fi.index), fi.defaultValue); err != nil {
+				return fmt.Errorf("%s: default: %w", fi.treeKey(), err)
+			}
+		} else if fi.required {
+			return fmt.Errorf("%s is required", fi.treeKey())
+		}
+	}
+	return nil
+}
+
+// decodeDefault decodes the default value from the tag. Defaults of composite fields are written in JSON.
+func decodeDefault(dst reflect.Value, s string) error {
+	t := dst.Type()
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map, reflect.Slice, reflect.Array:
+		if t != timeType && !reflect.PointerTo(t).Implements(textUnmarshalerType) {
+			var v any
+			if err := json.Unmarshal([]byte(s), &v); err != nil {
+				return err
+			}
+			return decodeValue(dst, v)
+		}
+	}
+	return decodeValue(dst, s)
+}
+
+func decodeDuration(dst reflect.Value, value any) error {
+	if s, isStr := value.(string); isStr {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return err
+		}
+		dst.SetInt(int64(d))
+		return nil
+	}
+	if d, isDuration := value.(time.Duration); isDuration {
+		dst.SetInt(int64(d))
+		return nil
+	}
+	// Numbers are nanoseconds as in encoding/json
+	if f, isNumber := toFloat(value); isNumber {
+		dst.SetInt(int64(f))
+		return nil
+	}
+	return fmt.Errorf("cannot decode %T into %s", value, dst.Type())
+}
+
+func decodeTime(dst reflect.Value, value any) error {
+	switch v := value.(type) {
+	case time.Time:
+		dst.Set(reflect.ValueOf(v))
+		return nil
+	case string:
+		t, err := time.Parse(time.RFC3339Nano, v)
+		if err != nil {
+			return err
+		}
+		dst.Set(reflect.ValueOf(t))
+		return nil
+	}
+	return fmt.Errorf("cannot decode %T into %s", value, dst.Type())
+}
+
+// Encode converts a Go value into a tree value, the reverse of Decode. Structs become maps keyed by the bound tree keys,
+// slices and arrays become []any, time.Duration, time.Time and encoding.TextMarshaler values become strings.
+func Encode(value any) any {
+	if value == nil {
+		return nil
+	}
+	return encodeValue(reflect.ValueOf(value))
+}
+
+func encodeValue(v reflect.Value) any {
+	if !v.IsValid() {
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Pointer, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return encodeValue(v.Elem())
+	}
+
+	if !v.CanInterface() {
+		return nil
+	}
+	switch value := v.Interface().(type) {
+	case time.Duration:
+		return value.String()
+	case time.Time:
+		return value.Format(time.RFC3339Nano)
+	case encoding.TextMarshaler:
+		if text, err := value.MarshalText(); err == nil {
+			return string(text)
+		}
+	}
+
+	switch v.Kind() {
+	case reflect.Struct:
+		result := map[string]any{}
+		for _, fi := range getStructFields(v.Type()).list {
+			f := v.FieldByIndex(fi.index)
+			if fi.omitEmpty && f.IsZero() {
+				continue
+			}
+			result[fi.treeKey()] = encodeValue(f)
+		}
+		return result
+
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		result := make(map[string]any, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			key, isStr := encodeValue(iter.Key()).(string)
+			if !isStr {
+				key = fmt.Sprint(iter.Key().Interface())
+			}
+			result[key] = encodeValue(iter.Value())
+		}
+		return result
+
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			return nil
+		}
+		result := make([]any, v.Len())
+		for i := range result {
+			result[i] = encodeValue(v.Index(i))
+		}
+		return result
+
+	// Named basic types are stored as the predeclared ones
+	case reflect.Bool:
+		return v.Bool()
+	case reflect.String:
+		return v.String()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return int(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return uint(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	}
+
+	return v.Interface()
+}
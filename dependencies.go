@@ -0,0 +1,220 @@
+package forjitree
+
+import "strings"
+
+// Dependent is implemented by objects which depend on the objects at the given paths (relative to the object node).
+// Objects are created after their dependencies and destroyed before them. Links in the object fields
+// (string values starting with @) are dependencies as well.
+type Dependent interface {
+	Dependencies() []string
+}
+
+// DependencyCycleError is reported for the objects which depend on each other. The cycle is broken at the object
+// which comes first in the patch, the objects are created in the order of the patch from there.
+type DependencyCycleError struct {
+	Paths []string
+}
+
+func (e *DependencyCycleError) Error() string {
+	return "dependency cycle: " + strings.Join(e.Paths, " -> ")
+}
+
+// resolveDependencies returns the nodes of the objects the object depends on
+func (n *node) resolveDependencies() []*node {
+	targets := []*node{}
+	if d, ok := n.obj.(Dependent); ok {
+		var paths []string
+		n.callObject("Dependencies", func() {
+			paths = d.Dependencies()
+		})
+		for _, p := range paths {
+			targets = append(targets, n.resolveDependency(p)...)
+		}
+	}
+
+	addLink := func(v *node) {
+		if s, isStr := v.value.(string); isStr && v.nodeType == NodeTypeValue && strings.HasPrefix(s, "@") {
+			targets = append(targets, n.resolveDependency(s[1:])...)
+		}
+	}
+	for k, v := range n.m {
+		if k == ObjectKeyword {
+			continue
+		}
+		addLink(v)
+		for _, item := range v.sl {
+			addLink(item)
+		}
+	}
+
+	// The dependency is the object of the target node or of its nearest parent
+	result := []*node{}
+	added := map[*node]bool{}
+	for _, target := range targets {
+		for o := target; o != nil; o = o.parent {
+			if o == n {
+				break
+			}
+			if o.objType != nil {
+				if !added[o] {
+					added[o] = true
+					result = append(result, o)
+				}
+				break
+			}
+		}
+	}
+	return result
+}
+
+// resolveDependency returns the nodes matching the dependency path, invalid paths are reported as the object errors
+func (n *node) resolveDependency(path string) []*node {
+	p, err := compilePathCached(path)
+	if err != nil {
+		n.tree.state.result.addError(n, err)
+		return nil
+	}
+	return n.getPath(p, true, false, true)
+}
+
+// sortByDependencies orders the nodes so the dependencies go first, the original order is kept where possible.
+// Cycles are broken at their node which comes first in the original order. Returns all nodes sorted
+// and the nodes which depend on each other in cycles.
+func sortByDependencies(nodes []*node, dependencies map[*node][]*node) ([]*node, [][]*node) {
+	index := map[*node]int{}
+	for i, n := range nodes {
+		index[n] = i
+	}
+
+	dependents := map[*node][]*node{}
+	waiting := map[*node]int{}
+	for _, n := range nodes {
+		for _, d := range dependencies[n] {
+			if _, ok := index[d]; ok && d != n {
+				dependents[d] = append(dependents[d], n)
+				waiting[n]++
+			}
+		}
+	}
+
+	sorted := make([]*node, 0, len(nodes))
+	done := map[*node]bool{}
+	cycles := [][]*node{}
+	for len(sorted) < len(nodes) {
+		next := -1
+		for i, n := range nodes {
+			if !done[n] && waiting[n] == 0 {
+				next = i
+				break
+			}
+		}
+
+		// The rest of the nodes are in cycles or depend on them
+		if next == -1 {
+			for _, n := range nodes {
+				if !done[n] {
+					cycle := findCycle(n, dependencies, index, done)
+					cycles = append(cycles, cycle)
+					next = index[cycle[0]]
+					for _, c := range cycle {
+						next = min(next, index[c])
+					}
+					break
+				}
+			}
+		}
+
+		n := nodes[next]
+		done[n] = true
+		sorted = append(sorted, n)
+		for _, d := range dependents[n] {
+			waiting[d]--
+		}
+	}
+	return sorted, cycles
+}
+
+// findCycle follows the unresolved dependencies from the node which is not sorted until a node repeats
+func findCycle(n *node, dependencies map[*node][]*node, index map[*node]int, done map[*node]bool) []*node {
+	path := []*node{}
+	position := map[*node]int{}
+	for {
+		if i, ok := position[n]; ok {
+			return path[i:]
+		}
+		position[n] = len(path)
+		path = append(path, n)
+
+		for _, d := range dependencies[n] {
+			if _, ok := index[d]; ok && d != n && !done[d] {
+				n = d
+				break
+			}
+		}
+	}
+}
+
+// createObjects calls Created of the prepared objects after their dependencies and returns the created ones
+func (t *Tree) createObjects(prepared []*node) []*node {
+	objs := map[*node]Object{}
+	dependencies := map[*node][]*node{}
+	for _, n := range prepared {
+		objs[n] = n.obj
+		n.dependencies = n.resolveDependencies()
+		dependencies[n] = n.dependencies
+	}
+
+	sorted, cycles := sortByDependencies(prepared, dependencies)
+
+	for _, cycle := range cycles {
+		paths := make([]string, len(cycle)+1)
+		for i, n := range cycle {
+			paths[i] = n.path()
+		}
+		paths[len(cycle)] = paths[0]
+		for _, n := range cycle {
+			t.state.result.addError(n, &DependencyCycleError{Paths: paths})
+		}
+	}
+
+	created := []*node{}
+	for _, n := range sorted {
+		// The object could have been replaced by the callbacks of the objects created before
+		if n.obj != objs[n] || n.objCreated {
+			continue
+		}
+		if !n.isAttached() {
+			n.discardObject()
+			continue
+		}
+		if n.createObject() {
+			created = append(created, n)
+		}
+	}
+	return created
+}
+
+// destroyObjects destroys the objects of the nodes, dependents before their dependencies
+func (t *Tree) destroyObjects(nodes []*node) {
+	unique := []*node{}
+	seen := map[*node]bool{}
+	for _, n := range nodes {
+		if !seen[n] {
+			seen[n] = true
+			unique = append(unique, n)
+		}
+	}
+
+	// Each object should wait for the objects which depend on it
+	dependents := map[*node][]*node{}
+	for _, n := range unique {
+		for _, d := range n.dependencies {
+			dependents[d] = append(dependents[d], n)
+		}
+	}
+
+	sorted, _ := sortByDependencies(unique, dependents)
+	for _, n := range sorted {
+		n.destroyObject(false)
+	}
+}
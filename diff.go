@@ -0,0 +1,185 @@
+package forjitree
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+const (
+	ChangeAdded = iota
+	ChangeUpdated
+	ChangeRemoved
+	ChangeTypeChanged
+)
+
+// Change describes a single difference between two tree values
+type Change struct {
+	Path     string
+	Kind     int
+	OldValue any
+	NewValue any
+}
+
+func (c Change) String() string {
+	path := c.Path
+	if path == "" {
+		path = "/"
+	}
+	switch c.Kind {
+	case ChangeAdded:
+		return fmt.Sprintf("+ %s: %v", path, c.NewValue)
+	case ChangeRemoved:
+		return fmt.Sprintf("- %s: %v", path, c.OldValue)
+	case ChangeTypeChanged:
+		return fmt.Sprintf("! %s: %v -> %v", path, c.OldValue, c.NewValue)
+	default:
+		return fmt.Sprintf("~ %s: %v -> %v", path, c.OldValue, c.NewValue)
+	}
+}
+
+// Diff makes a minimal patch that turns oldValue into newValue when applied with Tree.Set
+// and the list of changes between the values. The patch is nil if the values are equal.
+// Slices which become maps and maps which become slices are patched with Replace.
+func Diff(oldValue any, newValue any) (any, []Change) {
+	changes := []Change{}
+	patch, changed := diff(oldValue, newValue, "", &changes)
+	sort.SliceStable(changes, func(i, j int) bool {
+		return changes[i].Path < changes[j].Path
+	})
+	if !changed {
+		return nil, changes
+	}
+	return patch, changes
+}
+
+// DiffWith compares the current tree value with the new one
+func (t *Tree) DiffWith(value any) (any, []Change) {
+	return Diff(t.GetValue(), value)
+}
+
+// diffPatch is Diff without collecting the changes. Returns false if the values are equal.
+func diffPatch(oldValue any, newValue any) (any, bool) {
+	return diff(oldValue, newValue, "", nil)
+}
+
+func diff(oldValue any, newValue any, path string, changes *[]Change) (any, bool) {
+	addChange := func(kind int, path string, oldValue any, newValue any) {
+		if changes != nil {
+			*changes = append(*changes, Change{Path: path, Kind: kind, OldValue: oldValue, NewValue: newValue})
+		}
+	}
+
+	switch nv := newValue.(type) {
+	case map[string]any:
+		ov, ok := oldValue.(map[string]any)
+		if !ok {
+			addChange(ChangeTypeChanged, path, oldValue, newValue)
+			// A map patch would keep the items of the slice with the same indices
+			if _, isSlice := oldValue.([]any); isSlice {
+				return Replace(nv), true
+			}
+			return nv, true
+		}
+		patch := map[string]any{}
+		for k, v := range nv {
+			if old, exists := ov[k]; exists {
+				if p, changed := diff(old, v, path+"/"+k, changes); changed {
+					patch[k] = p
+				}
+			} else {
+				addChange(ChangeAdded, path+"/"+k, nil, v)
+				patch[k] = v
+			}
+		}
+		for k, v := range ov {
+			if _, exists := nv[k]; !exists {
+				addChange(ChangeRemoved, path+"/"+k, v, nil)
+				patch[k] = Delete
+			}
+		}
+		return patch, len(patch) > 0
+
+	case []any:
+		ov, ok := oldValue.([]any)
+		if !ok {
+			addChange(ChangeTypeChanged, path, oldValue, newValue)
+			if _, isMap := oldValue.(map[string]any); isMap {
+				return Replace(nv), true
+			}
+			return nv, true
+		}
+
+		// Common items are patched by indices, the tail items are deleted
+		patch := map[string]any{}
+		for i := 0; i < min(len(ov), len(nv)); i++ {
+			if p, changed := diff(ov[i], nv[i], path+"/"+strconv.Itoa(i), changes); changed {
+				patch[strconv.Itoa(i)] = p
+			}
+		}
+		if len(nv) <= len(ov) {
+			for i := len(nv); i < len(ov); i++ {
+				addChange(ChangeRemoved, path+"/"+strconv.Itoa(i), ov[i], nil)
+				patch[strconv.Itoa(i)] = Delete
+			}
+			return patch, len(patch) > 0
+		}
+
+		// New items are appended with a slice patch, the unchanged common items are patched with no-op values
+		slPatch := make([]any, len(nv))
+		for i := range nv {
+			if i >= len(ov) {
+				addChange(ChangeAdded, path+"/"+strconv.Itoa(i), nil, nv[i])
+				slPatch[i] = nv[i]
+			} else if p, changed := patch[strconv.Itoa(i)]; changed {
+				slPatch[i] = p
+			} else {
+				slPatch[i] = unchangedPatch(nv[i])
+			}
+		}
+		return slPatch, true
+
+	default:
+		if valuesIdentical(oldValue, newValue) {
+			return nil, false
+		}
+		switch oldValue.(type) {
+		case map[string]any, []any:
+			addChange(ChangeTypeChanged, path, oldValue, newValue)
+		default:
+			addChange(ChangeUpdated, path, oldValue, newValue)
+		}
+		return newValue, true
+	}
+}
+
+// unchangedPatch makes a patch which keeps the value as is, maps are patched with no keys
+func unchangedPatch(v any) any {
+	switch vt := v.(type) {
+	case map[string]any:
+		return map[string]any{}
+	case []any:
+		patch := make([]any, len(vt))
+		for i := range vt {
+			patch[i] = unchangedPatch(vt[i])
+		}
+		return patch
+	}
+	return v
+}
+
+// valuesIdentical compares values the same way the tree does when patching value nodes
+func valuesIdentical(a any, b any) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	ta := reflect.TypeOf(a)
+	if ta != reflect.TypeOf(b) {
+		return false
+	}
+	if ta.Comparable() {
+		return a == b
+	}
+	return reflect.DeepEqual(a, b)
+}
@@ -0,0 +1,192 @@
+package forjitree
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+)
+
+// FieldTag is the struct tag used to bind tree keys to object fields:
+//
+//	MaxRetries int    `forji:"max-retries,default=3"`
+//	Port       int    `forji:"http_port,required"`
+//	Name       string `forji:",omitempty"`
+//	Status     string `forji:"status,output"`
+//	Extra      map[string]any `forji:",extra"`
+//
+// Output fields are not set from the tree, instead their values are published to the tree after the lifecycle callbacks.
+// The extra field collects the keys without matching fields if the object type stores unknown keys, see UnknownKeysStore.
+// The json tag name is used if there is no forji tag. Fields without tags are bound by the capitalized key.
+const FieldTag = "forji"
+
+type fieldInfo struct {
+	index        []int
+	goName       string
+	key          string
+	required     bool
+	omitEmpty    bool
+	output       bool
+	extra        bool
+	hasDefault   bool
+	defaultValue string
+}
+
+type structFields struct {
+	byKey    map[string]*fieldInfo
+	byGoName map[string]*fieldInfo
+	list     []*fieldInfo
+
+	// Catch-all map[string]any field for the unknown keys
+	extra *fieldInfo
+}
+
+var structFieldsCache sync.Map
+
+// getStructFields returns the tree bindings of the struct fields, t may be a pointer to the struct
+func getStructFields(t reflect.Type) *structFields {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if cached, ok := structFieldsCache.Load(t); ok {
+		return cached.(*structFields)
+	}
+
+	fields := &structFields{
+		byKey:    map[string]*fieldInfo{},
+		byGoName: map[string]*fieldInfo{},
+	}
+	if t.Kind() == reflect.Struct {
+		collectStructFields(t, nil, fields)
+	}
+
+	cached, _ := structFieldsCache.LoadOrStore(t, fields)
+	return cached.(*structFields)
+}
+
+func collectStructFields(t reflect.Type, index []int, fields *structFields) {
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		fieldIndex := append(append([]int{}, index...), i)
+
+		tag, hasTag := sf.Tag.Lookup(FieldTag)
+		if !hasTag {
+			if jsonTag, hasJsonTag := sf.Tag.Lookup("json"); hasJsonTag {
+				// Only the name is taken from the json tag
+				tag = strings.Split(jsonTag, ",")[0]
+				hasTag = true
+			}
+		}
+		if tag == "-" {
+			continue
+		}
+
+		// Fields of embedded structs are promoted unless the embedded struct is tagged
+		if sf.Anonymous && sf.Type.Kind() == reflect.Struct && !hasTag {
+			collectStructFields(sf.Type, fieldIndex, fields)
+			continue
+		}
+		if !sf.IsExported() {
+			continue
+		}
+
+		fi := &fieldInfo{
+			index:  fieldIndex,
+			goName: sf.Name,
+		}
+
+		options := strings.Split(tag, ",")
+		fi.key = options[0]
+		for j := 1; j < len(options); j++ {
+			switch {
+			case options[j] == "required":
+				fi.required = true
+			case options[j] == "omitempty":
+				fi.omitEmpty = true
+			case options[j] == "output":
+				fi.output = true
+			case options[j] == "extra":
+				fi.extra = true
+			case strings.HasPrefix(options[j], "default="):
+				// The default value takes the rest of the tag, so it may contain commas
+				fi.hasDefault = true
+				fi.defaultValue = strings.TrimPrefix(strings.Join(options[j:], ","), "default=")
+				j = len(options)
+			}
+		}
+
+		if fi.extra {
+			if sf.Type.Kind() == reflect.Map && sf.Type.Key().Kind() == reflect.String && sf.Type.Elem().Kind() == reflect.Interface && sf.Type.Elem().NumMethod() == 0 &&
+				(fields.extra == nil || len(fields.extra.index) > len(fi.index)) {
+				fields.extra = fi
+			}
+			continue
+		}
+
+		// Outer fields shadow the promoted ones
+		if fi.key != "" {
+			if existing, ok := fields.byKey[fi.key]; !ok || len(existing.index) > len(fi.index) {
+				fields.byKey[fi.key] = fi
+			}
+		} else {
+			if existing, ok := fields.byGoName[fi.goName]; !ok || len(existing.index) > len(fi.index) {
+				fields.byGoName[fi.goName] = fi
+			}
+		}
+		fields.list = append(fields.list, fi)
+	}
+}
+
+func (s *structFields) lookup(key string) *fieldInfo {
+	if fi, ok := s.byKey[key]; ok {
+		return fi
+	}
+	if key == "" {
+		return nil
+	}
+	return s.byGoName[Capitalize(key)]
+}
+
+// setExtra stores the value of the unknown key in the extra field, nil removes the key
+func (s *structFields) setExtra(v reflect.Value, key string, value any) {
+	if s.extra == nil {
+		return
+	}
+	f := v.FieldByIndex(s.extra.index)
+	if !f.CanSet() {
+		return
+	}
+	mapKey := reflect.ValueOf(key).Convert(f.Type().Key())
+	if value == nil {
+		if !f.IsNil() {
+			f.SetMapIndex(mapKey, reflect.Value{})
+		}
+		return
+	}
+	if f.IsNil() {
+		f.Set(reflect.MakeMap(f.Type()))
+	}
+	f.SetMapIndex(mapKey, reflect.ValueOf(value))
+}
+
+// treeKey returns the key which is bound to the field
+func (fi *fieldInfo) treeKey() string {
+	if fi.key != "" {
+		return fi.key
+	}
+	runes := []rune(fi.goName)
+	runes[0] = []rune(strings.ToLower(string(runes[0])))[0]
+	return string(runes)
+}
+
+// isEmptyValue reports whether the tree value is treated as absent by omitempty fields
+func isEmptyValue(v any) bool {
+	if v == nil {
+		return true
+	}
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.String, reflect.Map, reflect.Slice, reflect.Array:
+		return rv.Len() == 0
+	}
+	return rv.IsZero()
+}
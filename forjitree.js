@@ -130,6 +130,17 @@ const NodeType = {
 }
 
 const ObjectKeyword = "object"
+const DeleteKeyword = "$delete"
+
+function isDelete(v) {
+    return v !== null && typeof v === 'object' && !Array.isArray(v) && Object.keys(v).length == 1 && v[DeleteKeyword] === true
+}
+
+const ReplaceKeyword = "$replace"
+
+function isReplace(v) {
+    return v !== null && typeof v === 'object' && !Array.isArray(v) && Object.keys(v).length == 1 && ReplaceKeyword in v
+}
 
 class ForjiNode {
 
@@ -180,6 +191,15 @@ class ForjiNode {
         let modified = false
         let modifiedSubnodes = []
 
+        // The node is reset before the replacement, so its old keys and items are not kept
+        if (isReplace(d)) {
+            let reset = this.setNodeType(NodeType.Value)
+            modifiedSubnodes = this.patch(d[ReplaceKeyword])
+            if (reset && !modifiedSubnodes.includes(this))
+                modifiedSubnodes.push(this)
+            return modifiedSubnodes
+        }
+
         if (d !== null && typeof d === 'object' && !Array.isArray(d)) {
 
             // if the node is a slice and all patch keys are existing indexes, we can keep the slice
@@ -193,16 +213,38 @@ class ForjiNode {
                     }
                 }
                 if (allKeysAreExistingIndices) {
+                    let deletedIndices = []
                     for (const k of Object.keys(d)) {
-                        modifiedSubnodes = modifiedSubnodes.concat(this.sl[parseInt(k)].patch(d[k]))
                         modified = true
+                        if (isDelete(d[k])) {
+                            deletedIndices.push(parseInt(k))
+                            continue
+                        }
+                        modifiedSubnodes = modifiedSubnodes.concat(this.sl[parseInt(k)].patch(d[k]))
+                    }
+
+                    // Remove deleted items starting from the end so the indices stay valid
+                    deletedIndices.sort((a, b) => b - a)
+                    for (const idx of deletedIndices) {
+                        this.sl[idx].destroyObject(true)
+                        this.sl.splice(idx, 1)
                     }
+                    for (let i = 0; i < this.sl.length; i++)
+                        this.sl[i].parentKey = i
                 }
             }
 
             if (!modified) {
                 modified = this.setNodeType(NodeType.Map)
                 for (const [k, v] of Object.entries(d)) {
+                    if (isDelete(v)) {
+                        if (this.m[k]) {
+                            this.m[k].destroyObject(true)
+                            delete this.m[k]
+                            modified = true
+                        }
+                        continue
+                    }
                     let n = this.m[k]
                     if (!n) {
                         n = new ForjiNode(this.tree, this, k)
@@ -0,0 +1,310 @@
+package forjitree
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// HistoryEntry is a single undo step. It contains all patches applied in the step
+// and their inverse patches which restore the previous state.
+type HistoryEntry struct {
+	Time     time.Time
+	Patches  []any
+	Inverses []any
+}
+
+type history struct {
+	limit int
+	undo  []*HistoryEntry
+	redo  []*HistoryEntry
+
+	groupDepth int
+	groupEntry *HistoryEntry
+}
+
+type historyMark struct {
+	undo       []*HistoryEntry
+	redo       []*HistoryEntry
+	groupEntry *HistoryEntry
+	groupLen   int
+}
+
+// inverseCapture holds the values of the nodes affected by a patch before it is applied
+type inverseCapture struct {
+	exists   bool
+	value    any
+	children map[string]*inverseCapture
+}
+
+// EnableHistory starts recording of the applied patches. limit is the maximum number of undo steps, 0 means unlimited.
+func (t *Tree) EnableHistory(limit int) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.history == nil {
+		t.history = &history{}
+	}
+	t.history.limit = limit
+	t.history.trim()
+}
+
+func (t *Tree) DisableHistory() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.history = nil
+}
+
+// History returns the undo steps starting from the oldest one
+func (t *Tree) History() []HistoryEntry {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	if t.history == nil {
+		return nil
+	}
+	result := make([]HistoryEntry, len(t.history.undo))
+	for i, e := range t.history.undo {
+		result[i] = *e
+	}
+	return result
+}
+
+func (t *Tree) CanUndo() bool {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return t.canUndo()
+}
+
+func (t *Tree) canUndo() bool {
+	return t.history != nil && len(t.history.undo) > 0
+}
+
+func (t *Tree) CanRedo() bool {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return t.canRedo()
+}
+
+func (t *Tree) canRedo() bool {
+	return t.history != nil && len(t.history.redo) > 0
+}
+
+// BeginHistoryGroup makes all following Set calls a single undo step until EndHistoryGroup is called.
+// Groups can be nested, the step is finished with the outermost EndHistoryGroup.
+func (t *Tree) BeginHistoryGroup() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.history == nil {
+		return
+	}
+	t.history.groupDepth++
+}
+
+func (t *Tree) EndHistoryGroup() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.history == nil || t.history.groupDepth == 0 {
+		return
+	}
+	t.history.groupDepth--
+	if t.history.groupDepth == 0 {
+		t.history.groupEntry = nil
+	}
+}
+
+func (t *Tree) Undo() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if !t.canUndo() {
+		return errors.New("nothing to undo")
+	}
+	h := t.history
+	e := h.undo[len(h.undo)-1]
+
+	t.state.applyingHistory = true
+	err := t.atomically(func() error {
+		for i := len(e.Inverses) - 1; i >= 0; i-- {
+			if err := t.set(e.Inverses[i]).Err(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	t.state.applyingHistory = false
+	if err != nil {
+		return err
+	}
+
+	h.undo = removeEntry(h.undo, e)
+	h.redo = append(h.redo, e)
+	h.groupEntry = nil
+	return nil
+}
+
+func (t *Tree) Redo() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if !t.canRedo() {
+		return errors.New("nothing to redo")
+	}
+	h := t.history
+	e := h.redo[len(h.redo)-1]
+
+	t.state.applyingHistory = true
+	err := t.atomically(func() error {
+		for _, p := range e.Patches {
+			if err := t.set(p).Err(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	t.state.applyingHistory = false
+	if err != nil {
+		return err
+	}
+
+	h.redo = removeEntry(h.redo, e)
+	h.undo = append(h.undo, e)
+	h.groupEntry = nil
+	return nil
+}
+
+// record adds the patches applied by a Set and their inverse patches to the current undo step
+func (h *history) record(patches []any, inverses []any) {
+	if len(patches) == 0 {
+		return
+	}
+	if h.groupEntry == nil {
+		h.groupEntry = &HistoryEntry{Time: time.Now()}
+		h.undo = append(h.undo, h.groupEntry)
+		h.trim()
+	}
+	for i, patch := range patches {
+		h.groupEntry.Patches = append(h.groupEntry.Patches, CloneValue(patch))
+		h.groupEntry.Inverses = append(h.groupEntry.Inverses, inverses[i])
+	}
+	h.redo = nil
+
+	if h.groupDepth == 0 {
+		h.groupEntry = nil
+	}
+}
+
+// removeEntry drops the applied step, the Set calls made while it was applied could have added steps after it
+func removeEntry(entries []*HistoryEntry, e *HistoryEntry) []*HistoryEntry {
+	for i := len(entries) - 1; i >= 0; i-- {
+		if entries[i] == e {
+			return append(entries[:i:i], entries[i+1:]...)
+		}
+	}
+	return entries
+}
+
+func (h *history) trim() {
+	if h.limit > 0 && len(h.undo) > h.limit {
+		h.undo = h.undo[len(h.undo)-h.limit:]
+	}
+}
+
+func (h *history) mark() *historyMark {
+	if h == nil {
+		return nil
+	}
+	m := &historyMark{
+		undo:       append([]*HistoryEntry{}, h.undo...),
+		redo:       append([]*HistoryEntry{}, h.redo...),
+		groupEntry: h.groupEntry,
+	}
+	if h.groupEntry != nil {
+		m.groupLen = len(h.groupEntry.Patches)
+	}
+	return m
+}
+
+func (h *history) restore(m *historyMark) {
+	if h == nil || m == nil {
+		return
+	}
+	h.undo = m.undo
+	h.redo = m.redo
+	h.groupEntry = m.groupEntry
+	if m.groupEntry != nil {
+		m.groupEntry.Patches = m.groupEntry.Patches[:m.groupLen]
+		m.groupEntry.Inverses = m.groupEntry.Inverses[:m.groupLen]
+	}
+}
+
+// captureInverse remembers the current values of the nodes which are going to be changed by the patch
+func (n *node) captureInverse(data any) *inverseCapture {
+	if n == nil {
+		return &inverseCapture{}
+	}
+
+	_, replaced := replacement(data)
+	if d, ok := data.(map[string]any); ok && !IsDelete(data) && !replaced {
+		mergeable := n.nodeType == NodeTypeMap
+		if n.nodeType == NodeTypeSlice {
+			// Only the patches of existing slice items without deletions and inserts keep the indices
+			mergeable = true
+			for k, v := range d {
+				_, insert := insertion(v)
+				if idx, err := strconv.Atoi(k); err != nil || idx < 0 || idx >= len(n.sl) || IsDelete(v) || insert {
+					mergeable = false
+					break
+				}
+			}
+		}
+
+		if mergeable {
+			c := &inverseCapture{exists: true, children: map[string]*inverseCapture{}}
+			for k, v := range d {
+				child := n.getChild(k)
+				if child == nil {
+					c.children[k] = &inverseCapture{}
+				} else if IsDelete(v) {
+					c.children[k] = &inverseCapture{exists: true, value: CloneValue(child.getValue())}
+				} else {
+					c.children[k] = child.captureInverse(v)
+				}
+			}
+			return c
+		}
+	}
+
+	return &inverseCapture{exists: true, value: CloneValue(n.getValue())}
+}
+
+// makeInverse makes a patch which restores the captured values
+func (n *node) makeInverse(c *inverseCapture) (any, bool) {
+	if !c.exists {
+		if n == nil {
+			return nil, false
+		}
+		return Delete, true
+	}
+
+	if n == nil {
+		return c.value, true
+	}
+
+	if c.children != nil {
+		inverse := map[string]any{}
+		for k, cc := range c.children {
+			if p, changed := n.getChild(k).makeInverse(cc); changed {
+				inverse[k] = p
+			}
+		}
+		return inverse, len(inverse) > 0
+	}
+
+	return diffPatch(n.getValue(), c.value)
+}
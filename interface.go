@@ -16,10 +16,20 @@ type Object interface {
 	Updated(string, any)
 }
 
+// ObjectLink is implemented by objects which stand for other nodes in the paths, e.g. subtrees.
+// Redirect is called with the tree locked, so it must not call the methods of the tree and its nodes,
+// which would take the lock again. It should return the nodes found beforehand, e.g. in Created.
 type ObjectLink interface {
 	Redirect() []Node
 }
 
+// Validator is implemented by objects which check their fields before Created.
+// An object which fails the validation or misses required fields is not created until the node is patched again,
+// it receives Destroyed instead of Created.
+type Validator interface {
+	Validate() error
+}
+
 type NewObjectFunc = func(Node) Object
 
 type PluginsGetTypesFunc = func() []string
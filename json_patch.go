@@ -0,0 +1,370 @@
+package forjitree
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// JSONPatchOperation is a single RFC 6902 operation
+type JSONPatchOperation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	From  string `json:"from,omitempty"`
+	Value any    `json:"value"`
+}
+
+var ErrJSONPatchTestFailed = errors.New("test failed")
+
+// ApplyJSONPatch applies RFC 6902 operations to the tree. The operations are applied to a copy of the tree value first,
+// so the tree is modified only if all of them succeed. Each operation becomes a patch, array items are removed and
+// inserted by index, so the objects of the other items are kept. The patches go through a single Set within a transaction.
+func (t *Tree) ApplyJSONPatch(ops []JSONPatchOperation) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	doc := CloneValue(t.rootNode.getValue())
+	patches := []any{}
+	for i, op := range ops {
+		var opPatches []any
+		var err error
+		doc, opPatches, err = applyJSONPatchOperation(doc, op)
+		if err != nil {
+			return fmt.Errorf("json patch operation %d (%s %s): %w", i, op.Op, op.Path, err)
+		}
+		patches = append(patches, opPatches...)
+	}
+
+	if len(patches) == 0 {
+		return nil
+	}
+	return t.atomically(func() error {
+		return t.setPatches(patches).Err()
+	})
+}
+
+// applyJSONPatchOperation applies the operation to the document and returns the patches which do the same to the tree
+func applyJSONPatchOperation(doc any, op JSONPatchOperation) (any, []any, error) {
+	path, err := parseJSONPointer(op.Path)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	switch op.Op {
+	case "add":
+		return jsonPatchAddStep(doc, path, CloneValue(op.Value), nil)
+
+	case "remove":
+		doc, _, patch, err := jsonPatchRemoveStep(doc, path)
+		return doc, []any{patch}, err
+
+	case "replace":
+		old, err := jsonPatchGet(doc, path)
+		if err != nil {
+			return nil, nil, err
+		}
+		value := CloneValue(op.Value)
+		var patches []any
+		if patch, changed := diffPatch(old, value); changed {
+			patches = append(patches, jsonPatchAt(path, patch))
+		}
+		if len(path) == 0 {
+			return value, patches, nil
+		}
+		doc, err = jsonPatchUpdate(doc, path, func(container any, key string) (any, error) {
+			switch c := container.(type) {
+			case map[string]any:
+				c[key] = value
+				return c, nil
+			case []any:
+				idx, _ := strconv.Atoi(key)
+				c[idx] = value
+				return c, nil
+			}
+			return nil, fmt.Errorf("path %s not found", op.Path)
+		})
+		return doc, patches, err
+
+	case "move":
+		from, err := parseJSONPointer(op.From)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(path) > len(from) && strings.HasPrefix(op.Path, op.From+"/") {
+			return nil, nil, fmt.Errorf("cannot move %s into its own child", op.From)
+		}
+		doc, value, patch, err := jsonPatchRemoveStep(doc, from)
+		if err != nil {
+			return nil, nil, err
+		}
+		return jsonPatchAddStep(doc, path, value, []any{patch})
+
+	case "copy":
+		from, err := parseJSONPointer(op.From)
+		if err != nil {
+			return nil, nil, err
+		}
+		value, err := jsonPatchGet(doc, from)
+		if err != nil {
+			return nil, nil, err
+		}
+		return jsonPatchAddStep(doc, path, CloneValue(value), nil)
+
+	case "test":
+		value, err := jsonPatchGet(doc, path)
+		if err != nil {
+			return nil, nil, err
+		}
+		if !jsonValuesEqual(value, op.Value) {
+			return nil, nil, fmt.Errorf("%w: value %v is not equal to %v", ErrJSONPatchTestFailed, value, op.Value)
+		}
+		return doc, nil, nil
+	}
+
+	return nil, nil, fmt.Errorf("unknown operation %q", op.Op)
+}
+
+// jsonPatchAddStep adds the value to the document and appends the patch which adds it to the tree.
+// Array items are inserted, an existing key is patched with the difference of the values.
+func jsonPatchAddStep(doc any, path []string, value any, patches []any) (any, []any, error) {
+	var patch any
+	changed := true
+	if len(path) == 0 {
+		patch, changed = diffPatch(doc, value)
+	} else {
+		parent, err := jsonPatchGet(doc, path[:len(path)-1])
+		if err != nil {
+			return nil, nil, err
+		}
+		key := path[len(path)-1]
+		switch c := parent.(type) {
+		case []any:
+			idx, err := jsonPatchArrayIndex(key, len(c), true)
+			if err != nil {
+				return nil, nil, err
+			}
+			patch = map[string]any{strconv.Itoa(idx): Insert(value)}
+		case map[string]any:
+			patch = value
+			if old, exists := c[key]; exists {
+				patch, changed = diffPatch(old, value)
+			}
+			patch = map[string]any{key: patch}
+		}
+		patch = jsonPatchAt(path[:len(path)-1], patch)
+	}
+
+	doc, err := jsonPatchAdd(doc, path, value)
+	if err != nil {
+		return nil, nil, err
+	}
+	if changed {
+		patches = append(patches, patch)
+	}
+	return doc, patches, nil
+}
+
+// jsonPatchRemoveStep removes the value from the document and returns it with the patch which deletes it in the tree
+func jsonPatchRemoveStep(doc any, path []string) (any, any, any, error) {
+	doc, removed, err := jsonPatchRemove(doc, path)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return doc, removed, jsonPatchAt(path, Delete), nil
+}
+
+// jsonPatchAt nests the patch into the keys of the path, the keys of arrays are the item indices
+func jsonPatchAt(path []string, patch any) any {
+	for i := len(path) - 1; i >= 0; i-- {
+		patch = map[string]any{path[i]: patch}
+	}
+	return patch
+}
+
+// parseJSONPointer splits an RFC 6901 pointer into unescaped reference tokens
+func parseJSONPointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return []string{}, nil
+	}
+	if !strings.HasPrefix(pointer, "/") {
+		return nil, fmt.Errorf("invalid json pointer %q: should start with /", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, t := range tokens {
+		tokens[i] = strings.ReplaceAll(strings.ReplaceAll(t, "~1", "/"), "~0", "~")
+	}
+	return tokens, nil
+}
+
+func jsonPatchArrayIndex(key string, length int, allowEnd bool) (int, error) {
+	if allowEnd && key == "-" {
+		return length, nil
+	}
+	idx, err := strconv.Atoi(key)
+	if err != nil || idx < 0 || (key != "0" && strings.HasPrefix(key, "0")) {
+		return 0, fmt.Errorf("invalid array index %q", key)
+	}
+	if idx > length || (!allowEnd && idx == length) {
+		return 0, fmt.Errorf("array index %d is out of bounds", idx)
+	}
+	return idx, nil
+}
+
+func jsonPatchGet(doc any, path []string) (any, error) {
+	for i, key := range path {
+		switch d := doc.(type) {
+		case map[string]any:
+			v, ok := d[key]
+			if !ok {
+				return nil, fmt.Errorf("path /%s not found", strings.Join(path[:i+1], "/"))
+			}
+			doc = v
+		case []any:
+			idx, err := jsonPatchArrayIndex(key, len(d), false)
+			if err != nil {
+				return nil, err
+			}
+			doc = d[idx]
+		default:
+			return nil, fmt.Errorf("path /%s not found", strings.Join(path[:i+1], "/"))
+		}
+	}
+	return doc, nil
+}
+
+// jsonPatchUpdate finds the parent container of the path and replaces it with the result of f
+func jsonPatchUpdate(doc any, path []string, f func(container any, key string) (any, error)) (any, error) {
+	if len(path) == 1 {
+		return f(doc, path[0])
+	}
+
+	switch d := doc.(type) {
+	case map[string]any:
+		child, ok := d[path[0]]
+		if !ok {
+			return nil, fmt.Errorf("path element %s not found", path[0])
+		}
+		newChild, err := jsonPatchUpdate(child, path[1:], f)
+		if err != nil {
+			return nil, err
+		}
+		d[path[0]] = newChild
+		return d, nil
+
+	case []any:
+		idx, err := jsonPatchArrayIndex(path[0], len(d), false)
+		if err != nil {
+			return nil, err
+		}
+		newChild, err := jsonPatchUpdate(d[idx], path[1:], f)
+		if err != nil {
+			return nil, err
+		}
+		d[idx] = newChild
+		return d, nil
+	}
+
+	return nil, fmt.Errorf("path element %s not found", path[0])
+}
+
+func jsonPatchAdd(doc any, path []string, value any) (any, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return jsonPatchUpdate(doc, path, func(container any, key string) (any, error) {
+		switch c := container.(type) {
+		case map[string]any:
+			c[key] = value
+			return c, nil
+		case []any:
+			idx, err := jsonPatchArrayIndex(key, len(c), true)
+			if err != nil {
+				return nil, err
+			}
+			c = append(c, nil)
+			copy(c[idx+1:], c[idx:])
+			c[idx] = value
+			return c, nil
+		}
+		return nil, fmt.Errorf("cannot add %s to a value", key)
+	})
+}
+
+func jsonPatchRemove(doc any, path []string) (any, any, error) {
+	if len(path) == 0 {
+		return nil, nil, errors.New("cannot remove the root")
+	}
+	var removed any
+	doc, err := jsonPatchUpdate(doc, path, func(container any, key string) (any, error) {
+		switch c := container.(type) {
+		case map[string]any:
+			v, ok := c[key]
+			if !ok {
+				return nil, fmt.Errorf("key %s not found", key)
+			}
+			removed = v
+			delete(c, key)
+			return c, nil
+		case []any:
+			idx, err := jsonPatchArrayIndex(key, len(c), false)
+			if err != nil {
+				return nil, err
+			}
+			removed = c[idx]
+			return append(c[:idx:idx], c[idx+1:]...), nil
+		}
+		return nil, fmt.Errorf("key %s not found", key)
+	})
+	return doc, removed, err
+}
+
+// jsonValuesEqual compares values by JSON semantics: numbers of different Go types are equal if their values are equal
+func jsonValuesEqual(a any, b any) bool {
+	switch at := a.(type) {
+	case map[string]any:
+		bt, ok := b.(map[string]any)
+		if !ok || len(at) != len(bt) {
+			return false
+		}
+		for k, v := range at {
+			v2, ok := bt[k]
+			if !ok || !jsonValuesEqual(v, v2) {
+				return false
+			}
+		}
+		return true
+	case []any:
+		bt, ok := b.([]any)
+		if !ok || len(at) != len(bt) {
+			return false
+		}
+		for i := range at {
+			if !jsonValuesEqual(at[i], bt[i]) {
+				return false
+			}
+		}
+		return true
+	}
+
+	af, aIsNumber := toFloat(a)
+	bf, bIsNumber := toFloat(b)
+	if aIsNumber || bIsNumber {
+		return aIsNumber && bIsNumber && af == bf
+	}
+	return reflect.DeepEqual(a, b)
+}
+
+func toFloat(v any) (float64, bool) {
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(rv.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return float64(rv.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return rv.Float(), true
+	}
+	return 0, false
+}
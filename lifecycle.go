@@ -0,0 +1,169 @@
+package forjitree
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+)
+
+// Starter is implemented by objects which run in the background, e.g. servers and pollers.
+// Start is called by Tree.Start after CreatedTree and for the objects created later while the tree is started.
+// It should not block, long-running work should be done in goroutines.
+type Starter interface {
+	Start(ctx context.Context) error
+}
+
+// Stopper is implemented by objects which should be stopped gracefully. Stop is called by Tree.Shutdown
+// and before Destroyed of the objects which are destroyed while the tree is started, with the tree unlocked.
+type Stopper interface {
+	Stop(ctx context.Context) error
+}
+
+// StopTimeout limits Stop of the objects which are destroyed while the tree is started
+var StopTimeout = 10 * time.Second
+
+// Start creates the tree (see Created) and starts all objects in the order of dependencies. ctx is passed
+// to Start of the objects, including the ones created later until Shutdown.
+func (t *Tree) Start(ctx context.Context) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.started {
+		return errors.New("tree is already started")
+	}
+	t.createTree()
+	t.started = true
+	t.startCtx = ctx
+
+	errs := []error{}
+	for _, n := range t.objectsInDependencyOrder() {
+		if err := n.startObject(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Shutdown stops the started objects, dependents before their dependencies. Stop of the objects is called
+// without the tree lock, so they can wait for their goroutines which use the tree. If ctx is done before
+// all objects are stopped, the rest of them are still stopped with the done ctx and its error is returned.
+func (t *Tree) Shutdown(ctx context.Context) error {
+	t.lock.Lock()
+	if !t.started {
+		t.lock.Unlock()
+		return nil
+	}
+	t.started = false
+	t.startCtx = nil
+
+	stoppers := []Stopper{}
+	errorInfos := []*ObjectError{}
+	nodes := t.objectsInDependencyOrder()
+	for i := len(nodes) - 1; i >= 0; i-- {
+		n := nodes[i]
+		if !n.objStarted {
+			continue
+		}
+		n.objStarted = false
+		if s, ok := n.obj.(Stopper); ok {
+			stoppers = append(stoppers, s)
+			errorInfos = append(errorInfos, newObjectError(n, nil))
+		}
+	}
+	t.lock.Unlock()
+
+	errs := []error{}
+	for i, s := range stoppers {
+		if err := callStop(ctx, s); err != nil {
+			errorInfos[i].Err = err
+			errs = append(errs, errorInfos[i])
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		errs = append(errs, fmt.Errorf("shutdown: %w", err))
+	}
+	return errors.Join(errs...)
+}
+
+func (t *Tree) IsStarted() bool {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return t.started
+}
+
+// objectsInDependencyOrder returns the nodes of the created objects, dependencies before their dependents
+func (t *Tree) objectsInDependencyOrder() []*node {
+	nodes := []*node{}
+	dependencies := map[*node][]*node{}
+	for _, n := range append([]*node{t.rootNode}, t.rootNode.getChildren(true)...) {
+		if n.objCreated {
+			nodes = append(nodes, n)
+			dependencies[n] = n.dependencies
+		}
+	}
+	sorted, _ := sortByDependencies(nodes, dependencies)
+	return sorted
+}
+
+// startObject starts the object if the tree is started
+func (n *node) startObject() error {
+	if !n.tree.started || !n.objCreated || n.objStarted {
+		return nil
+	}
+	s, ok := n.obj.(Starter)
+	if !ok {
+		n.objStarted = true
+		return nil
+	}
+
+	var err error
+	obj, ctx := n.obj, n.tree.startCtx
+	if !n.callObject("Start", func() {
+		err = s.Start(ctx)
+	}) {
+		return newObjectError(n, n.failure)
+	}
+	if err != nil {
+		n.fail(fmt.Errorf("start: %w", err))
+		return newObjectError(n, n.failure)
+	}
+
+	// The tree could have been shut down or the object destroyed while it was starting, nobody else stops it then
+	if !n.tree.started || n.obj != obj {
+		if stopper, ok := obj.(Stopper); ok {
+			n.stop(stopper)
+		}
+		return nil
+	}
+	n.objStarted = true
+	return nil
+}
+
+// stop calls Stop limited by StopTimeout, the values of the Start ctx are kept while the tree is started
+func (n *node) stop(s Stopper) {
+	parent := n.tree.startCtx
+	if parent == nil {
+		parent = context.Background()
+	}
+	var err error
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(parent), StopTimeout)
+	defer cancel()
+	n.callObject("Stop", func() {
+		err = s.Stop(ctx)
+	})
+	if err != nil {
+		n.fail(fmt.Errorf("stop: %w", err))
+	}
+}
+
+func callStop(ctx context.Context, s Stopper) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{Callback: "Stop", Value: r, Stack: debug.Stack()}
+		}
+	}()
+	return s.Stop(ctx)
+}
@@ -0,0 +1,136 @@
+package forjitree
+
+import "sync"
+
+// treeLock is a single-writer/multi-reader lock shared by all nodes of a tree.
+//
+// The exported methods of Tree and Node take the lock and call the unexported helpers, which expect the lock
+// to be held and never take it again. Patches are applied to the nodes under the write lock, so readers observe
+// whole patches only. Redirect and the registered path functions are called with the lock held, so a read sees
+// a single state of the tree; only the nodes of other trees reached by links and redirects are read under the lock
+// of their own tree. The other code of the users (object callbacks, the error handler and the subscribers) is called
+// with the lock released, see Tree.unlocked: it can use the exported API of the tree including Set and wait for other
+// goroutines which use the tree. Set calls made meanwhile by the callbacks or by other goroutines are applied between
+// the callbacks of the Set in progress.
+type treeLock struct {
+	sync.RWMutex
+
+	// Set while the write lock is held, only the writer changes it and readers can't hold the lock at that time
+	writing bool
+}
+
+func (l *treeLock) Lock() {
+	l.RWMutex.Lock()
+	l.writing = true
+}
+
+func (l *treeLock) Unlock() {
+	l.writing = false
+	l.RWMutex.Unlock()
+}
+
+// lockedNode is passed to the registered path functions which are called with the tree locked. Its methods read
+// the tree without locking and return lockedNode as well, the changes would deadlock and panic with ErrReadOnly.
+type lockedNode struct {
+	*node
+}
+
+// lockedNodes wraps the nodes of the locked tree, the nodes of other trees keep locking their own tree
+func lockedNodes(t *Tree, nodes []*node) []Node {
+	result := make([]Node, len(nodes))
+	for i, n := range nodes {
+		if n.tree == t {
+			result[i] = lockedNode{n}
+		} else {
+			result[i] = n
+		}
+	}
+	return result
+}
+
+func (n lockedNode) Get(path string) []Node {
+	return n.GetEx(path, true, true, true)
+}
+
+func (n lockedNode) GetEx(path string, links bool, redirects bool, avoidDuplicates bool) []Node {
+	return lockedNodes(n.tree, n.getEx(path, links, redirects, avoidDuplicates))
+}
+
+func (n lockedNode) GetOne(path string) Node {
+	if result := n.getOne(path); result != nil {
+		return lockedNodes(n.tree, []*node{result})[0]
+	}
+	return nil
+}
+
+func (n lockedNode) GetPath(p *Path) []Node {
+	return lockedNodes(n.tree, n.getPath(p, true, true, true))
+}
+
+func (n lockedNode) Query(q any) (any, error) {
+	return n.query(q)
+}
+
+func (n lockedNode) Value() any {
+	return n.getValue()
+}
+
+func (n lockedNode) Parent() Node {
+	if n.parent == nil {
+		return nil
+	}
+	return lockedNode{n.parent}
+}
+
+func (n lockedNode) Root() Node {
+	return lockedNode{n.tree.rootNode}
+}
+
+func (n lockedNode) Name() string {
+	if n.parent == nil {
+		return n.tree.name
+	}
+	return n.parentKey
+}
+
+func (n lockedNode) Path() string {
+	return n.path()
+}
+
+func (n lockedNode) NodeType() int {
+	return n.nodeType
+}
+
+func (n lockedNode) Err() error {
+	return n.failure
+}
+
+func (n lockedNode) Set(newValue any) {
+	panic(ErrReadOnly)
+}
+
+func (n lockedNode) CleanNulls(recursive bool) {
+	panic(ErrReadOnly)
+}
+
+func (n lockedNode) Publish(key string, value any) {
+	panic(ErrReadOnly)
+}
+
+// unlocked calls the user code with the lock held by the caller released and takes it back afterwards.
+// The state of the Set in progress is restored, the Set calls made meanwhile have their own.
+func (t *Tree) unlocked(f func()) {
+	if t.lock.writing {
+		state := t.state
+		t.state = setState{}
+		t.lock.Unlock()
+		defer func() {
+			t.lock.Lock()
+			t.state = state
+		}()
+	} else {
+		t.lock.RUnlock()
+		defer t.lock.RLock()
+	}
+	f()
+}
@@ -4,9 +4,10 @@ import (
 	"errors"
 	"fmt"
 	"reflect"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
-	"sync"
 )
 
 const (
@@ -17,6 +18,61 @@ const (
 
 const ObjectKeyword = "object"
 
+// DeleteKeyword is the directive used by serialized patches to remove a key, e.g. {"key": {"$delete": true}}
+const DeleteKeyword = "$delete"
+
+// Delete can be used as a value in a patch to remove the key from its parent node
+var Delete any = deleteMarker{}
+
+type deleteMarker struct{}
+
+// ReplaceKeyword is the directive which replaces the node with the value instead of merging the value into it,
+// e.g. {"key": {"$replace": {}}}. Diff uses it when a slice becomes a map or back.
+const ReplaceKeyword = "$replace"
+
+// Replace makes a patch value which replaces the node instead of being merged into it
+func Replace(v any) any {
+	return map[string]any{ReplaceKeyword: v}
+}
+
+// replacement returns the value of the replace directive
+func replacement(v any) (any, bool) {
+	if m, ok := v.(map[string]any); ok && len(m) == 1 {
+		r, ok := m[ReplaceKeyword]
+		return r, ok
+	}
+	return nil, false
+}
+
+// InsertKeyword is the directive which inserts the value into a slice before the item with the index of the key,
+// e.g. {"list": {"0": {"$insert": 1}}}. The index equal to the length of the slice appends the value.
+const InsertKeyword = "$insert"
+
+// Insert makes a patch value which is inserted into the slice instead of replacing the item
+func Insert(v any) any {
+	return map[string]any{InsertKeyword: v}
+}
+
+// insertion returns the value of the insert directive
+func insertion(v any) (any, bool) {
+	if m, ok := v.(map[string]any); ok && len(m) == 1 {
+		r, ok := m[InsertKeyword]
+		return r, ok
+	}
+	return nil, false
+}
+
+func IsDelete(v any) bool {
+	if _, ok := v.(deleteMarker); ok {
+		return true
+	}
+	if m, ok := v.(map[string]any); ok && len(m) == 1 {
+		d, ok := m[DeleteKeyword].(bool)
+		return ok && d
+	}
+	return false
+}
+
 type node struct {
 	tree      *Tree
 	parent    *node
@@ -26,17 +82,31 @@ type node struct {
 	m        map[string]*node
 	sl       []*node
 	nodeType int
-	mu       sync.RWMutex
 
 	obj        Object
 	objReflect reflect.Value
 	objType    *ObjectType
+	objCreated bool
+	objStarted bool
+
+	// Error of the last failed lifecycle callback of the object
+	failure error
+
+	// Name of the unknown type the node references, see Tree.unknownTypeNodes
+	unknownType string
+
+	// Nodes of the objects this object depends on, resolved when the object is created or updated
+	dependencies []*node
+
+	// Keys removed by the last patch, the object fields are reset in synchronize
+	removedKeys []string
 }
 
 type Node interface {
 	Get(key string) []Node
 	GetEx(key string, links bool, redirects bool, avoidDuplicates bool) []Node
 	GetOne(key string) Node
+	GetPath(p *Path) []Node
 	Set(newValue any)
 	Query(q any) (any, error)
 	Value() any
@@ -47,6 +117,8 @@ type Node interface {
 	Tree() *Tree
 	NodeType() int
 	CleanNulls(recursive bool)
+	Publish(key string, value any)
+	Err() error
 	internalNode() *node
 }
 
@@ -67,16 +139,12 @@ func (n *node) setNodeType(newNodeType int) bool {
 
 	n.destroyObject(true)
 
-	n.mu.Lock()
-
 	n.m = make(map[string]*node)
 	n.sl = make([]*node, 0)
 	n.value = nil
 
 	n.nodeType = newNodeType
 
-	n.mu.Unlock()
-
 	return true
 }
 
@@ -84,23 +152,15 @@ func (n *node) getValue() any {
 	switch n.nodeType {
 	case NodeTypeMap:
 		m := make(map[string]any)
-		n.mu.RLock()
 		for k, v := range n.m {
-			n.mu.RUnlock()
 			m[k] = v.getValue()
-			n.mu.RLock()
 		}
-		n.mu.RUnlock()
 		return m
 	case NodeTypeSlice:
 		sl := make([]any, len(n.sl))
-		n.mu.RLock()
 		for i, v := range n.sl {
-			n.mu.RUnlock()
 			sl[i] = v.getValue()
-			n.mu.RLock()
 		}
-		n.mu.RUnlock()
 		return sl
 	case NodeTypeValue:
 		return n.value
@@ -116,20 +176,28 @@ func (n *node) query(q any) (any, error) {
 
 	// String query
 	if qStr, qIsStr := q.(string); qIsStr {
-		nodes := n.GetEx(qStr, true, true, true)
+		nodes := n.getEx(qStr, true, true, true)
 		result := map[string]any{}
-		for _, n := range nodes {
+		for _, n1 := range nodes {
 
 			// Get the full path of each node including the name of the tree (if defined)
-			treeName := n.Tree().GetName()
-			path := n.Path()
+			// Redirected nodes may belong to other trees, they are read with the locking methods
+			var treeName, path string
+			var value any
+			if n1.tree == n.tree {
+				treeName, path, value = n.tree.name, n1.path(), n1.getValue()
+			} else {
+				n.tree.unlocked(func() {
+					treeName, path, value = n1.Tree().GetName(), n1.Path(), n1.Value()
+				})
+			}
 			fullPath := treeName
 			if len(treeName) > 0 && len(path) > 0 {
 				fullPath += "/"
 			}
 			fullPath += path
 
-			patch := MakePatchWithPath(fullPath, n.Value(), true)
+			patch := MakePatchWithPath(fullPath, value, true)
 			if patchMap, ok := patch.(map[string]any); ok {
 				MergeMaps(result, patchMap)
 			}
@@ -186,24 +254,66 @@ func (n *node) patch(data any) []*node {
 	modified := false
 	modifiedSubnodes := []*node{}
 
+	n.tree.save(n)
+
+	if IsDelete(data) {
+		data = nil
+	}
+
+	// Values are inserted by the slice nodes, the other nodes just set them
+	if v, ok := insertion(data); ok {
+		data = v
+	}
+
+	// The node is reset before the replacement, so its old keys and items are not kept
+	if v, ok := replacement(data); ok {
+		reset := n.setNodeType(NodeTypeValue)
+		modifiedNodes := n.patch(v)
+		if reset && (len(modifiedNodes) == 0 || modifiedNodes[len(modifiedNodes)-1] != n) {
+			modifiedNodes = append(modifiedNodes, n)
+		}
+		return modifiedNodes
+	}
+
 	switch d := data.(type) {
 	case map[string]any:
 
-		// if the node is a slice and all patch keys are existing indexes, we can keep the slice
+		// if the node is a slice and all patch keys are existing indexes (or the length for inserts), we can keep the slice
 		if n.nodeType == NodeTypeSlice {
 			allKeysAreExistingIndices := true
-			for k := range d {
-				if idx, err := strconv.Atoi(k); err != nil || idx > len(n.sl)-1 || idx < 0 {
+			for k, v := range d {
+				_, insert := insertion(v)
+				if idx, err := strconv.Atoi(k); err != nil || idx > len(n.sl)-1 && !(insert && idx == len(n.sl)) || idx < 0 {
 					allKeysAreExistingIndices = false
 					break
 				}
 			}
 			if allKeysAreExistingIndices {
+				// The indices of deletions and inserts refer to the items before the patch
+				shifts := map[int]any{}
 				for k, v := range d {
 					kidx, _ := strconv.Atoi(k)
+					modified = true
+					if _, insert := insertion(v); insert || IsDelete(v) {
+						shifts[kidx] = v
+						continue
+					}
 					subnode := n.sl[kidx]
 					modifiedSubnodes = append(modifiedSubnodes, subnode.patch(v)...)
-					modified = true
+				}
+
+				// Remove and insert items starting from the end so the indices stay valid
+				shiftIndices := make([]int, 0, len(shifts))
+				for idx := range shifts {
+					shiftIndices = append(shiftIndices, idx)
+				}
+				sort.Sort(sort.Reverse(sort.IntSlice(shiftIndices)))
+				for _, idx := range shiftIndices {
+					if v, insert := insertion(shifts[idx]); insert {
+						modifiedSubnodes = append(modifiedSubnodes, n.insertChild(idx, v)...)
+					} else {
+						n.removeChild(strconv.Itoa(idx))
+					}
 				}
 			}
 		}
@@ -211,13 +321,17 @@ func (n *node) patch(data any) []*node {
 		if !modified {
 			modified = n.setNodeType(NodeTypeMap)
 			for k, v := range d {
-				n.mu.Lock()
+				if IsDelete(v) {
+					if n.removeChild(k) != nil {
+						modified = true
+					}
+					continue
+				}
 				if _, ok := n.m[k]; !ok {
 					n.m[k] = newNode(n.tree, n, k)
 					modified = true
 				}
 				subnode := n.m[k]
-				n.mu.Unlock()
 				modifiedSubnodes = append(modifiedSubnodes, subnode.patch(v)...)
 			}
 		}
@@ -226,21 +340,17 @@ func (n *node) patch(data any) []*node {
 		modified = n.setNodeType(NodeTypeSlice)
 
 		for i, v := range d {
-			n.mu.Lock()
 			if len(n.sl) <= i {
 				n.sl = append(n.sl, newNode(n.tree, n, strconv.Itoa(i)))
 				modified = true
 			}
 			subnode := n.sl[i]
-			n.mu.Unlock()
 			modifiedSubnodes = append(modifiedSubnodes, subnode.patch(v)...)
 		}
 		if len(n.sl) > len(d) {
-			n.mu.Lock()
 			slCopy := make([]*node, len(n.sl))
 			copy(slCopy, n.sl)
 			n.sl = n.sl[:len(d)]
-			n.mu.Unlock()
 			for i := len(d); i < len(slCopy); i++ {
 				slCopy[i].destroyObject(true)
 			}
@@ -249,12 +359,10 @@ func (n *node) patch(data any) []*node {
 
 	default:
 		modified = n.setNodeType(NodeTypeValue)
-		n.mu.Lock()
 		if n.value != data {
 			modified = true
 		}
 		n.value = data
-		n.mu.Unlock()
 	}
 
 	if modified || len(modifiedSubnodes) > 0 {
@@ -264,19 +372,89 @@ func (n *node) patch(data any) []*node {
 	}
 }
 
-func (n *node) synchronize() bool {
-	var createdObj = false
+// removeChild detaches the child node with the given key and destroys all objects in its subtree.
+// Slice items after the removed one are shifted. Returns the removed node or nil if the key doesn't exist.
+func (n *node) removeChild(key string) *node {
+	var removed *node
 
-	var newType *ObjectType = nil
-	if n.nodeType == NodeTypeMap {
-		n.mu.RLock()
-		typeNode, typeNodeExists := n.m[ObjectKeyword]
-		if typeNodeExists && typeNode.nodeType == NodeTypeValue && typeNode.value != nil {
-			if typeValue, typeValueIsStr := typeNode.value.(string); typeValueIsStr {
-				newType = n.tree.GetType(typeValue)
+	switch n.nodeType {
+	case NodeTypeMap:
+		if v, ok := n.m[key]; ok {
+			removed = v
+			delete(n.m, key)
+			n.removedKeys = append(n.removedKeys, key)
+		}
+	case NodeTypeSlice:
+		if i, err := strconv.Atoi(key); err == nil && i >= 0 && i < len(n.sl) {
+			removed = n.sl[i]
+			n.sl = append(n.sl[:i:i], n.sl[i+1:]...)
+			for j := i; j < len(n.sl); j++ {
+				n.tree.save(n.sl[j])
+				n.sl[j].parentKey = strconv.Itoa(j)
 			}
 		}
-		n.mu.RUnlock()
+	}
+
+	if removed == nil {
+		return nil
+	}
+
+	removed.destroyObject(true)
+	return removed
+}
+
+// insertChild inserts a new slice item before the item with the index and patches it with the value.
+// Slice items after the inserted one are shifted.
+func (n *node) insertChild(idx int, value any) []*node {
+	child := newNode(n.tree, n, strconv.Itoa(idx))
+	n.sl = append(n.sl, nil)
+	copy(n.sl[idx+1:], n.sl[idx:])
+	n.sl[idx] = child
+	for j := idx + 1; j < len(n.sl); j++ {
+		n.tree.save(n.sl[j])
+		n.sl[j].parentKey = strconv.Itoa(j)
+	}
+	return child.patch(value)
+}
+
+// resolveType returns the registered type referenced by the object key of the node
+// or the name of the type if it is not registered
+func (n *node) resolveType() (*ObjectType, string) {
+	if n.nodeType != NodeTypeMap {
+		return nil, ""
+	}
+	typeNode, typeNodeExists := n.m[ObjectKeyword]
+	if !typeNodeExists || typeNode.nodeType != NodeTypeValue || typeNode.value == nil {
+		return nil, ""
+	}
+	typeValue, typeValueIsStr := typeNode.value.(string)
+	if !typeValueIsStr {
+		return nil, ""
+	}
+	if t := n.tree.getType(typeValue); t != nil {
+		return t, ""
+	}
+	return nil, typeValue
+}
+
+// synchronize makes the object of the node match its type and sets the fields.
+// Returns true if a new object is prepared, Created is called for it later in the order of dependencies.
+func (n *node) synchronize() bool {
+	var preparedObj = false
+
+	// The node could have been removed by the callbacks of the nodes synchronized before
+	if !n.isAttached() {
+		return false
+	}
+
+	newType, unknownType := n.resolveType()
+
+	// Nodes of unknown types are synchronized again when the type is added
+	if unknownType != "" {
+		n.tree.state.result.unknownType(n, unknownType)
+		n.tree.trackUnknownType(n, unknownType)
+	} else {
+		n.tree.untrackUnknownType(n)
 	}
 
 	if newType != n.objType {
@@ -285,86 +463,231 @@ func (n *node) synchronize() bool {
 		}
 
 		if newType != nil {
+			// The failure of the previous object is forgotten, the new one is prepared from scratch
+			n.failure = nil
 			n.objType = newType
-			n.obj = newType.createObject(n)
+			var obj Object
+			n.callObject("New", func() {
+				obj = newType.createObject(n)
+			})
+			if n.objType != newType || n.obj != nil || !n.isAttached() {
+				// The node has been synchronized or removed by another Set meanwhile
+				if n.objType == newType && n.obj == nil {
+					n.objType = nil
+				}
+				if obj != nil {
+					n.callObject("Destroyed", obj.Destroyed)
+				}
+				return false
+			}
+			n.obj = obj
+			if n.obj == nil {
+				n.objType = nil
+				return false
+			}
 			n.objReflect = reflect.ValueOf(n.obj)
 
 			// Set all fields immediately before calling Created
-			n.mu.RLock()
 			for k, v := range n.m {
 				if k == ObjectKeyword {
 					continue
 				}
-				n.mu.RUnlock()
 				n.objType.setField(n, k, v.getValue())
-				n.mu.RLock()
 			}
-			n.mu.RUnlock()
 
-			n.obj.Created()
-			createdObj = true
+			valid := n.failure == nil && n.validateObject()
+			if n.obj != obj {
+				// The object has been discarded by another Set meanwhile
+				return false
+			}
+			if !valid || !n.isAttached() {
+				// The object is not created until the node is patched with the valid values
+				n.discardObject()
+				return false
+			}
+			preparedObj = true
+		}
+	}
+
+	// Reset fields of removed keys
+	removedKeys := n.removedKeys
+	n.removedKeys = nil
+	if n.objType != nil && !preparedObj && n.nodeType == NodeTypeMap {
+		for _, k := range removedKeys {
+			if k != ObjectKeyword {
+				n.objType.setField(n, k, nil)
+			}
 		}
 	}
 
-	if n.parent != nil && n.parent.nodeType == NodeTypeMap && n.parent.objType != nil && n.parentKey != ObjectKeyword {
+	if n.objCreated {
+		n.dependencies = n.resolveDependencies()
+	}
+
+	// All fields of a new object are set when it is prepared
+	if n.parent != nil && n.parent.nodeType == NodeTypeMap && n.parent.objCreated && n.parentKey != ObjectKeyword {
 		n.parent.objType.setField(n.parent, n.parentKey, n.getValue())
 	}
 
-	return createdObj
+	return preparedObj
+}
+
+// createObject calls Created of the prepared object
+func (n *node) createObject() bool {
+	obj := n.obj
+	if !n.callObject("Created", obj.Created) {
+		// The failed object is retried on the next patch as well
+		if n.obj == obj && !n.objCreated {
+			n.discardObject()
+		}
+		return false
+	}
+	if n.obj != obj {
+		// The object has been discarded by another Set meanwhile
+		return false
+	}
+	n.objCreated = true
+	n.tree.state.result.objectCreated(n)
+	if !n.isAttached() {
+		// The node has been removed while the object was created
+		n.destroyObject(false)
+		return false
+	}
+	return true
 }
 
 func (n *node) destroyObject(callNested bool) {
 	if callNested {
+		// The node is removed from the tree
+		n.tree.untrackUnknownType(n)
+
 		switch n.nodeType {
 		case NodeTypeMap:
-			n.mu.RLock()
 			for _, v := range n.m {
-				n.mu.RUnlock()
 				v.destroyObject(true)
-				n.mu.RLock()
 			}
-			n.mu.RUnlock()
 		case NodeTypeSlice:
-			n.mu.RLock()
 			for _, v := range n.sl {
-				n.mu.RUnlock()
 				v.destroyObject(true)
-				n.mu.RLock()
 			}
-			n.mu.RUnlock()
 		}
 	}
 
 	if n.objType != nil {
-		n.obj.Destroyed()
+		if !n.objCreated {
+			n.discardObject()
+			return
+		}
+		// Objects of the removed nodes are destroyed during the synchronization in the order of dependencies
+		if n.tree.deferDestroy {
+			n.tree.pendingDestroy = append(n.tree.pendingDestroy, n)
+			return
+		}
+		// The node is cleared first, so the Set calls made while the object stops don't destroy it again
+		obj, started := n.obj, n.objStarted
+		n.tree.state.result.objectDestroyed(n)
 		n.objType = nil
 		n.obj = nil
 		n.objReflect = reflect.Value{}
+		n.objCreated = false
+		n.objStarted = false
+		n.dependencies = nil
+		if s, ok := obj.(Stopper); ok && started {
+			n.stop(s)
+		}
+		n.callObject("Destroyed", obj.Destroyed)
+	}
+}
+
+// callObject calls the lifecycle callback of the object with the tree unlocked. A panic is recovered, the node
+// is marked as failed and the error is reported to the result of the current Set and to the tree error handler.
+func (n *node) callObject(callback string, f func()) bool {
+	var panicErr *PanicError
+	n.tree.unlocked(func() {
+		defer func() {
+			if r := recover(); r != nil {
+				panicErr = &PanicError{Callback: callback, Value: r, Stack: debug.Stack()}
+			}
+		}()
+		f()
+	})
+	if panicErr != nil {
+		n.fail(panicErr)
+		return false
+	}
+	return true
+}
+
+func (n *node) fail(err error) {
+	n.failure = err
+	objErr := newObjectError(n, err)
+	n.tree.state.result.addObjectError(objErr)
+	if h := n.tree.errorHandler; h != nil {
+		n.tree.unlocked(func() {
+			h(objErr)
+		})
+	}
+}
+
+// validateObject checks the required fields and calls Validate of the object which fields are set.
+// The errors are reported to the result.
+func (n *node) validateObject() bool {
+	if missing := n.objType.setDefaultFields(n); len(missing) > 0 {
+		n.tree.state.result.addError(n, fmt.Errorf("required fields are missing: %s", strings.Join(missing, ", ")))
+		return false
+	}
+	var err error
+	if v, ok := n.obj.(Validator); ok {
+		if !n.callObject("Validate", func() {
+			err = v.Validate()
+		}) {
+			return false
+		}
 	}
+	if err != nil {
+		n.tree.state.result.addError(n, err)
+		return false
+	}
+	return true
+}
+
+// discardObject drops the object which has not been created yet. Destroyed is called for it anyway,
+// the object could have acquired resources in its constructor or Updated.
+func (n *node) discardObject() {
+	if obj := n.obj; obj != nil {
+		defer n.callObject("Destroyed", obj.Destroyed)
+	}
+
+	n.objType = nil
+	n.obj = nil
+	n.objReflect = reflect.Value{}
+	n.objCreated = false
+	n.objStarted = false
+	n.dependencies = nil
+}
+
+// objFields returns the field bindings of the object or nil if the object is not a pointer to a struct
+func (n *node) objFields() *structFields {
+	if !n.objReflect.IsValid() || n.objReflect.Kind() != reflect.Pointer || n.objReflect.Elem().Kind() != reflect.Struct {
+		return nil
+	}
+	return getStructFields(n.objReflect.Type())
 }
 
 func (n *node) callCreatedTree() {
 	if n.objType != nil {
-		n.obj.CreatedTree()
+		n.callObject("CreatedTree", n.obj.CreatedTree)
 	}
 
 	switch n.nodeType {
 	case NodeTypeMap:
-		n.mu.RLock()
 		for _, v := range n.m {
-			n.mu.RUnlock()
 			v.callCreatedTree()
-			n.mu.RLock()
 		}
-		n.mu.RUnlock()
 	case NodeTypeSlice:
-		n.mu.RLock()
 		for _, v := range n.sl {
-			n.mu.RUnlock()
 			v.callCreatedTree()
-			n.mu.RLock()
 		}
-		n.mu.RUnlock()
 	}
 }
 
@@ -377,17 +700,13 @@ func (n *node) getChild(key string) *node {
 
 	switch n.nodeType {
 	case NodeTypeMap:
-		n.mu.RLock()
 		if v, ok := n.m[key]; ok {
 			result = v
 		}
-		n.mu.RUnlock()
 	case NodeTypeSlice:
-		n.mu.RLock()
 		if i, err := strconv.Atoi(key); err == nil && i >= 0 && i < len(n.sl) {
 			result = n.sl[i]
 		}
-		n.mu.RUnlock()
 	}
 
 	return result
@@ -398,27 +717,49 @@ func (n *node) getChildren(recursive bool) []*node {
 
 	switch n.nodeType {
 	case NodeTypeMap:
-		n.mu.RLock()
 		for _, v := range n.m {
-			n.mu.RUnlock()
 			result = append(result, v)
 			if recursive {
 				result = append(result, v.getChildren(true)...)
 			}
-			n.mu.RLock()
 		}
-		n.mu.RUnlock()
 	case NodeTypeSlice:
-		n.mu.RLock()
 		for _, v := range n.sl {
-			n.mu.RUnlock()
 			result = append(result, v)
 			if recursive {
 				result = append(result, v.getChildren(true)...)
 			}
-			n.mu.RLock()
 		}
-		n.mu.RUnlock()
+	}
+
+	return result
+}
+
+// getSortedChildren is like getChildren but the children of maps go in the order of their keys
+func (n *node) getSortedChildren(recursive bool) []*node {
+	var result []*node
+
+	switch n.nodeType {
+	case NodeTypeMap:
+		keys := make([]string, 0, len(n.m))
+		for k := range n.m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v := n.m[k]
+			result = append(result, v)
+			if recursive {
+				result = append(result, v.getSortedChildren(true)...)
+			}
+		}
+	case NodeTypeSlice:
+		for _, v := range n.sl {
+			result = append(result, v)
+			if recursive {
+				result = append(result, v.getSortedChildren(true)...)
+			}
+		}
 	}
 
 	return result
@@ -435,9 +776,40 @@ func (n *node) getParents() []*node {
 	return result
 }
 
+func (n *node) depth() int {
+	d := 0
+	for p := n.parent; p != nil; p = p.parent {
+		d++
+	}
+	return d
+}
+
+// isAttached checks whether the node is still reachable from the root of its tree
+func (n *node) isAttached() bool {
+	for c := n; c.parent != nil; c = c.parent {
+		if c.parent.getChild(c.parentKey) != c {
+			return false
+		}
+	}
+	return n.tree.rootNode != nil && n.root() == n.tree.rootNode
+}
+
+func (n *node) root() *node {
+	c := n
+	for c.parent != nil {
+		c = c.parent
+	}
+	return c
+}
+
 func internalGet(nodes []*node, t pathToken, links bool, redirects bool, avoidDuplicates bool) []*node {
 	// TODO: detect loops
 
+	// Selectors of the matched nodes see all of them at once
+	if t.Kind == PathTokenKindIndex && !t.Index.Items {
+		return t.Index.apply(nodes)
+	}
+
 	var result []*node
 
 	appendPostprocess := func(n *node) {
@@ -449,16 +821,12 @@ func internalGet(nodes []*node, t pathToken, links bool, redirects bool, avoidDu
 
 		if vStr, vIsStr := n.value.(string); links && n.nodeType == NodeTypeValue && vIsStr && strings.HasPrefix(vStr, "@") && n.parent != nil {
 			// Links (string values starting with @)
-			subResult := n.parent.GetEx(vStr[1:], links, redirects, avoidDuplicates)
-			for _, subNode := range subResult {
-				appendArr = append(appendArr, subNode.(*node))
-			}
+			appendArr = append(appendArr, n.parent.getEx(vStr[1:], links, redirects, avoidDuplicates)...)
 		} else if redirects && n.objType != nil {
 			// Object redirect (for subtrees support)
 			objLink, objLinkSupported := n.obj.(ObjectLink)
 			if objLinkSupported {
-				redirectNodes := objLink.Redirect()
-				for _, n2 := range redirectNodes {
+				for _, n2 := range objLink.Redirect() {
 					appendArr = append(appendArr, n2.internalNode())
 				}
 			} else {
@@ -475,7 +843,7 @@ func internalGet(nodes []*node, t pathToken, links bool, redirects bool, avoidDu
 				for i := 0; i < len(result); i++ {
 					if result[i] == n2 {
 						exists = true
-						return
+						break
 					}
 				}
 				if !exists {
@@ -493,7 +861,7 @@ func internalGet(nodes []*node, t pathToken, links bool, redirects bool, avoidDu
 			appendPostprocess(n)
 
 		} else if t.Kind == PathTokenKindParent {
-			appendPostprocess(n.Parent().(*node))
+			appendPostprocess(n.parent)
 
 		} else if t.Kind == PathTokenKindAllParents {
 			parents := n.getParents()
@@ -508,157 +876,25 @@ func internalGet(nodes []*node, t pathToken, links bool, redirects bool, avoidDu
 			appendPostprocess(n.getChild(t.Key))
 
 		} else if t.Kind == PathTokenKindParams {
-			satisfied := true
-
-		loop:
-			for _, p := range t.Params {
-
-				switch p.ParamType {
-				case ParamTypeEquals:
-					if p.Key == "_key" {
-						if n.parentKey != p.Value {
-							satisfied = false
-							break loop
-						}
-					} else {
-						n1 := n.GetOne(p.Key)
-						if n1 == nil || fmt.Sprintf("%v", n1.Value()) != p.Value {
-							satisfied = false
-							break loop
-						}
-					}
-
-				case ParamTypeNotEquals:
-					n1 := n.GetOne(p.Key)
-					if n1 == nil || fmt.Sprintf("%v", n1.Value()) == p.Value {
-						satisfied = false
-						break loop
-					}
-
-				case ParamTypeGreaterThan:
-					n1 := n.GetOne(p.Key)
-					if n1 == nil {
-						satisfied = false
-						break loop
-					}
-					n1FloatValue, err := strconv.ParseFloat(fmt.Sprintf("%v", n1.Value()), 64)
-					if err != nil {
-						satisfied = false
-						break loop
-					}
-					pFloatValue, err := strconv.ParseFloat(p.Value, 64)
-					if err != nil {
-						satisfied = false
-						break loop
-					}
-					if n1FloatValue <= pFloatValue {
-						satisfied = false
-						break loop
-					}
-
-				case ParamTypeLessThan:
-					n1 := n.GetOne(p.Key)
-					if n1 == nil {
-						satisfied = false
-						break loop
-					}
-					n1FloatValue, err := strconv.ParseFloat(fmt.Sprintf("%v", n1.Value()), 64)
-					if err != nil {
-						satisfied = false
-						break loop
-					}
-					pFloatValue, err := strconv.ParseFloat(p.Value, 64)
-					if err != nil {
-						satisfied = false
-						break loop
-					}
-					if n1FloatValue >= pFloatValue {
-						satisfied = false
-						break loop
-					}
-
-				case ParamTypeGreaterOrEquals:
-					n1 := n.GetOne(p.Key)
-					if n1 == nil {
-						satisfied = false
-						break loop
-					}
-					n1FloatValue, err := strconv.ParseFloat(fmt.Sprintf("%v", n1.Value()), 64)
-					if err != nil {
-						satisfied = false
-						break loop
-					}
-					pFloatValue, err := strconv.ParseFloat(p.Value, 64)
-					if err != nil {
-						satisfied = false
-						break loop
-					}
-					if n1FloatValue < pFloatValue {
-						satisfied = false
-						break loop
-					}
-
-				case ParamTypeLessOrEquals:
-					n1 := n.GetOne(p.Key)
-					if n1 == nil {
-						satisfied = false
-						break loop
-					}
-					n1FloatValue, err := strconv.ParseFloat(fmt.Sprintf("%v", n1.Value()), 64)
-					if err != nil {
-						satisfied = false
-						break loop
-					}
-					pFloatValue, err := strconv.ParseFloat(p.Value, 64)
-					if err != nil {
-						satisfied = false
-						break loop
-					}
-					if n1FloatValue > pFloatValue {
-						satisfied = false
-						break loop
-					}
-
-				case ParamTypePresence:
-					n1 := n.GetOne(p.Key)
-					if n1 == nil {
-						satisfied = false
-						break loop
-					}
-
-				case ParamTypeNotPresence:
-					n1 := n.GetOne(p.Key)
-					if n1 != nil {
-						satisfied = false
-						break loop
-					}
+			if t.Filter.match(n) {
+				appendPostprocess(n)
+			}
 
-				case ParamTypeRegex:
-					n1 := n.GetOne(p.Key)
-					if n1 == nil || p.ValueRegex == nil {
-						satisfied = false
-						break loop
-					}
-					n1Str := fmt.Sprintf("%v", n1.Value())
-					if !p.ValueRegex.MatchString(n1Str) {
-						satisfied = false
-						break loop
-					}
+		} else if t.Kind == PathTokenKindIndex {
+			if n.nodeType == NodeTypeSlice {
+				for _, item := range t.Index.apply(n.sl) {
+					appendPostprocess(item)
 				}
-
-			}
-			if satisfied {
-				appendPostprocess(n)
 			}
 
 		} else if t.Kind == PathTokenKindDirectChildren {
-			subs := n.getChildren(false)
+			subs := n.getSortedChildren(false)
 			for _, sub := range subs {
 				appendPostprocess(sub)
 			}
 
 		} else if t.Kind == PathTokenKindAllChildren {
-			subs := n.getChildren(true)
+			subs := n.getSortedChildren(true)
 			for _, sub := range subs {
 				appendPostprocess(sub)
 			}
@@ -669,17 +905,66 @@ func internalGet(nodes []*node, t pathToken, links bool, redirects bool, avoidDu
 	return result
 }
 
-func (n *node) GetEx(path string, links bool, redirects bool, avoidDuplicates bool) []Node {
-	tokenizedPath := TokenizePath(path)
+// getEx returns the nodes matching the path, nothing is matched by invalid paths, their syntax errors are logged
+func (n *node) getEx(path string, links bool, redirects bool, avoidDuplicates bool) []*node {
+	p, err := compilePathCached(path)
+	if err != nil {
+		return nil
+	}
+	return n.getPath(p, links, redirects, avoidDuplicates)
+}
+
+func (n *node) getPath(p *Path, links bool, redirects bool, avoidDuplicates bool) []*node {
+	result := []*node{n}
+	var foreign []*node
+	foreignAdded := map[*node]bool{}
+	for i := range p.tokens {
+		result = internalGet(result, p.tokens[i], links, redirects, avoidDuplicates)
+
+		// The nodes redirected to other trees are matched with the rest of the path under the lock of their tree
+		local := result[:0:0]
+		for _, n1 := range result {
+			if n1.tree == n.tree {
+				local = append(local, n1)
+				continue
+			}
+			rest := &Path{source: p.source, tokens: p.tokens[i+1:]}
+			n.tree.unlocked(func() {
+				n1.tree.lock.RLock()
+				defer n1.tree.lock.RUnlock()
+				for _, n2 := range n1.getPath(rest, links, redirects, avoidDuplicates) {
+					if !avoidDuplicates || !foreignAdded[n2] {
+						foreignAdded[n2] = true
+						foreign = append(foreign, n2)
+					}
+				}
+			})
+		}
+		result = local
+	}
+	return append(result, foreign...)
+}
 
-	if len(tokenizedPath) == 0 {
-		return []Node{n}
+func (n *node) getOne(path string) *node {
+	arr := n.getEx(path, true, true, true)
+	if len(arr) == 0 {
+		return nil
 	}
+	return arr[0]
+}
 
-	tempResult := []*node{n}
-	for i := range tokenizedPath {
-		tempResult = internalGet(tempResult, tokenizedPath[i], links, redirects, avoidDuplicates)
+func (n *node) path() string {
+	if n.parent == nil {
+		return ""
 	}
+	return n.parent.path() + "/" + n.parentKey
+}
+
+func (n *node) GetEx(path string, links bool, redirects bool, avoidDuplicates bool) []Node {
+	n.tree.lock.RLock()
+	defer n.tree.lock.RUnlock()
+
+	tempResult := n.getEx(path, links, redirects, avoidDuplicates)
 
 	result := make([]Node, len(tempResult))
 	for i := range tempResult {
@@ -692,31 +977,58 @@ func (n *node) Get(path string) []Node {
 	return n.GetEx(path, true, true, true)
 }
 
+// GetPath returns the nodes matching the compiled path, following links and redirects as Get does
+func (n *node) GetPath(p *Path) []Node {
+	n.tree.lock.RLock()
+	defer n.tree.lock.RUnlock()
+
+	tempResult := n.getPath(p, true, true, true)
+
+	result := make([]Node, len(tempResult))
+	for i := range tempResult {
+		result[i] = tempResult[i]
+	}
+	return result
+}
+
 func (n *node) GetOne(path string) Node {
-	arr := n.Get(path)
-	if len(arr) == 0 {
-		return nil
+	n.tree.lock.RLock()
+	defer n.tree.lock.RUnlock()
+
+	if result := n.getOne(path); result != nil {
+		return result
 	}
-	return arr[0]
+	return nil
 }
 
 func (n *node) Query(q any) (any, error) {
+	n.tree.lock.RLock()
+	defer n.tree.lock.RUnlock()
 	return n.query(q)
 }
 
 func (n *node) Value() any {
+	n.tree.lock.RLock()
+	defer n.tree.lock.RUnlock()
 	return n.getValue()
 }
 
 func (n *node) Parent() Node {
-	return n.getParent()
+	if n.parent == nil {
+		return nil
+	}
+	return n.parent
 }
 
 func (n *node) Root() Node {
+	n.tree.lock.RLock()
+	defer n.tree.lock.RUnlock()
 	return n.tree.rootNode
 }
 
 func (n *node) Name() string {
+	n.tree.lock.RLock()
+	defer n.tree.lock.RUnlock()
 	if n.parent == nil {
 		return n.tree.name
 	}
@@ -724,10 +1036,9 @@ func (n *node) Name() string {
 }
 
 func (n *node) Path() string {
-	if n.parent == nil {
-		return ""
-	}
-	return n.parent.Path() + "/" + n.parentKey
+	n.tree.lock.RLock()
+	defer n.tree.lock.RUnlock()
+	return n.path()
 }
 
 func (n *node) Tree() *Tree {
@@ -735,28 +1046,108 @@ func (n *node) Tree() *Tree {
 }
 
 func (n *node) Set(newValue any) {
-	n.tree.Set(MakePatchWithPath(strings.TrimPrefix(n.Path(), "/"), newValue, false))
+	n.checkWritable()
+	n.tree.lock.Lock()
+	defer n.tree.lock.Unlock()
+	n.tree.set(MakePatchWithPath(strings.TrimPrefix(n.path(), "/"), newValue, false))
+}
+
+// checkWritable panics if the node belongs to a snapshot, the methods of Node which change the tree don't return errors
+func (n *node) checkWritable() {
+	if n.tree.readOnly {
+		panic(ErrReadOnly)
+	}
 }
 
 func (n *node) NodeType() int {
+	n.tree.lock.RLock()
+	defer n.tree.lock.RUnlock()
 	return n.nodeType
 }
 
 func (n *node) CleanNulls(recursive bool) {
+	n.checkWritable()
+	n.tree.lock.Lock()
+	defer n.tree.lock.Unlock()
+
 	subs := n.getChildren(recursive)
 
+	// Remove null values from maps with a delete patch so objects and watchers are notified
+	patch := map[string]any{}
 	for _, n2 := range subs {
-		if n2.nodeType == NodeTypeValue && n2.value == nil {
-			p := n2.parent
-			pKey := n2.parentKey
-
-			if p.nodeType == NodeTypeMap {
-				p.mu.Lock()
-				delete(p.m, pKey)
-				p.mu.Unlock()
+		if n2.nodeType == NodeTypeValue && n2.value == nil && n2.parent.nodeType == NodeTypeMap {
+			if p, ok := MakePatchWithPath(strings.TrimPrefix(n2.path(), "/"), Delete, false).(map[string]any); ok {
+				MergeMaps(patch, p)
 			}
 		}
 	}
+
+	if len(patch) > 0 {
+		n.tree.set(patch)
+	}
+}
+
+// Publish sets the key of the node on behalf of its object. Watchers, subscribers and other objects are notified
+// as with Set, but the object itself does not receive Updated for the published value.
+func (n *node) Publish(key string, value any) {
+	n.checkWritable()
+	n.tree.lock.Lock()
+	defer n.tree.lock.Unlock()
+
+	n.publish(map[string]any{key: value})
+}
+
+func (n *node) publish(patch map[string]any) {
+	if !n.isAttached() {
+		return
+	}
+	publishing := n.tree.state.publishing
+	n.tree.state.publishing = n
+	defer func() {
+		n.tree.state.publishing = publishing
+	}()
+	n.tree.set(MakePatchWithPath(strings.TrimPrefix(n.path(), "/"), patch, false))
+}
+
+// publishOutputs publishes the values of the object output fields which differ from the node values
+func (n *node) publishOutputs() {
+	if n.objType == nil || n.nodeType != NodeTypeMap {
+		return
+	}
+	fields := n.objFields()
+	if fields == nil {
+		return
+	}
+
+	patch := map[string]any{}
+	for _, fi := range fields.list {
+		if !fi.output {
+			continue
+		}
+		key := fi.treeKey()
+		value := encodeValue(n.objReflect.Elem().FieldByIndex(fi.index))
+		var current any
+		if child, exists := n.m[key]; exists {
+			current = child.getValue()
+		} else if value == nil {
+			continue
+		}
+		if p, changed := diffPatch(current, value); changed {
+			patch[key] = p
+		}
+	}
+
+	if len(patch) > 0 {
+		n.publish(patch)
+	}
+}
+
+// Err returns the error of the last failed lifecycle callback of the node object, nil if there was no failure
+// since the object was last validated
+func (n *node) Err() error {
+	n.tree.lock.RLock()
+	defer n.tree.lock.RUnlock()
+	return n.failure
 }
 
 func (n *node) internalNode() *node {
@@ -767,10 +1158,10 @@ func GetObjs[T any](nodes []Node) []T {
 	result := []T{}
 	for _, nIntf := range nodes {
 		n, isNode := nIntf.(*node)
-		if !isNode || n.objType == nil {
+		if !isNode {
 			continue
 		}
-		if obj, objIsRightType := n.obj.(T); objIsRightType {
+		if obj, objIsRightType := n.getObj().(T); objIsRightType {
 			result = append(result, obj)
 		}
 	}
@@ -780,13 +1171,22 @@ func GetObjs[T any](nodes []Node) []T {
 func GetObj[T any](nodes []Node) T {
 	for _, nIntf := range nodes {
 		n, isNode := nIntf.(*node)
-		if !isNode || n.objType == nil {
+		if !isNode {
 			continue
 		}
-		if obj, objIsRightType := n.obj.(T); objIsRightType {
+		if obj, objIsRightType := n.getObj().(T); objIsRightType {
 			return obj
 		}
 	}
 	var result T
 	return result
 }
+
+func (n *node) getObj() Object {
+	n.tree.lock.RLock()
+	defer n.tree.lock.RUnlock()
+	if n.objType == nil {
+		return nil
+	}
+	return n.obj
+}
@@ -3,14 +3,30 @@ package forjitree
 import (
 	"fmt"
 	"plugin"
-	"reflect"
 	"regexp"
 	"strings"
 )
 
+// Policies for the node keys which have no matching fields in the object struct
+const (
+	UnknownKeysIgnore = iota
+	UnknownKeysStore
+	UnknownKeysError
+)
+
 type ObjectType struct {
 	Name          string
 	newObjectFunc NewObjectFunc
+
+	// Name of the type this one is derived from, empty for the original types
+	Base string
+
+	// Values of the keys which are absent in the node, they are set to the object fields before Created
+	DefaultData map[string]any
+
+	// Policy for the keys without matching fields: ignored (passed to Updated only), stored in the extra field
+	// (see FieldTag) or reported as errors
+	UnknownKeys int
 }
 
 func NewObjectType(newObjectFunc NewObjectFunc, name string) *ObjectType {
@@ -20,6 +36,25 @@ func NewObjectType(newObjectFunc NewObjectFunc, name string) *ObjectType {
 	}
 }
 
+// Derive makes a new type with the same objects. The default data of the new type is merged over the data of this type,
+// the unknown keys policy is inherited.
+func (t *ObjectType) Derive(name string, defaultData map[string]any) *ObjectType {
+	derived := &ObjectType{
+		Name:          name,
+		newObjectFunc: t.newObjectFunc,
+		Base:          t.Name,
+		DefaultData:   map[string]any{},
+		UnknownKeys:   t.UnknownKeys,
+	}
+	for k, v := range t.DefaultData {
+		derived.DefaultData[k] = CloneValue(v)
+	}
+	for k, v := range defaultData {
+		derived.DefaultData[k] = CloneValue(v)
+	}
+	return derived
+}
+
 var pluginRegex = regexp.MustCompile(`syms\:map\[(.*)\]`)
 
 func NewObjectTypesFromPlugin(pluginFilename string) ([]*ObjectType, error) {
@@ -69,23 +104,105 @@ func (t *ObjectType) createObject(node Node) Object {
 	return t.newObjectFunc(node)
 }
 
+// setField decodes the tree value into the object field bound to the key and notifies the object with Updated
 func (t *ObjectType) setField(n *node, fieldName string, fieldValue any) {
-	f := n.objReflect.Elem().FieldByName(Capitalize(fieldName))
-	if f.IsValid() && f.CanSet() {
+	// The object could have been discarded by another Set while the previous fields were set
+	if n.obj == nil {
+		return
+	}
 
-		fieldValueType := reflect.TypeOf(fieldValue)
-		fieldType := f.Type()
+	if fieldValue == nil {
+		fieldValue = t.defaultValue(fieldName)
+	}
 
-		if fieldValue == nil {
-			if fieldType.Kind() == reflect.Interface || fieldType.Kind() == reflect.Pointer || fieldType.Kind() == reflect.Map || fieldType.Kind() == reflect.Array {
-				f.Set(NilReflectValue)
-			} else {
-				f.Set(reflect.Zero(fieldType))
+	if fields := n.objFields(); fields != nil {
+		fi := fields.lookup(fieldName)
+		if fi == nil {
+			switch t.UnknownKeys {
+			case UnknownKeysStore:
+				fields.setExtra(n.objReflect.Elem(), fieldName, fieldValue)
+			case UnknownKeysError:
+				if fieldValue != nil {
+					n.tree.state.result.addError(n, fmt.Errorf("unknown key %s", fieldName))
+					return
+				}
+			}
+		} else if !fi.output {
+			if f := n.objReflect.Elem().FieldByIndex(fi.index); f.CanSet() {
+				if fi.omitEmpty && isEmptyValue(fieldValue) {
+					fieldValue = nil
+				}
+				var err error
+				if fieldValue == nil && fi.hasDefault {
+					err = decodeDefault(f, fi.defaultValue)
+					fieldValue = f.Interface()
+				} else {
+					err = decodeValue(f, fieldValue)
+				}
+				if err != nil {
+					n.tree.state.result.addError(n, fmt.Errorf("field %s: %w", fieldName, err))
+				}
 			}
-		} else if fieldValueType != nil && fieldValueType.ConvertibleTo(fieldType) {
-			f.Set(reflect.ValueOf(fieldValue).Convert(fieldType))
 		}
 	}
 
-	n.obj.Updated(fieldName, fieldValue)
+	// The object is not notified about the values it publishes itself
+	if n.tree.state.publishing == n {
+		return
+	}
+
+	obj := n.obj
+	n.callObject("Updated", func() {
+		obj.Updated(fieldName, fieldValue)
+	})
+	if n.objCreated {
+		n.tree.state.result.objectUpdated(n)
+	}
+}
+
+// setDefaultFields applies the type default data and the tag defaults to the fields which keys are absent in the node
+// and returns the keys of the absent required fields
+func (t *ObjectType) setDefaultFields(n *node) []string {
+	values := map[string]any{}
+	for k, v := range n.m {
+		if value := v.getValue(); value != nil {
+			values[k] = value
+		}
+	}
+	for k, v := range t.DefaultData {
+		if _, exists := values[k]; !exists && v != nil {
+			values[k] = v
+			t.setField(n, k, CloneValue(v))
+		}
+	}
+
+	fields := n.objFields()
+	if fields == nil {
+		return nil
+	}
+
+	present := map[*fieldInfo]bool{}
+	for k, v := range values {
+		if fi := fields.lookup(k); fi != nil && !(fi.omitEmpty && isEmptyValue(v)) {
+			present[fi] = true
+		}
+	}
+
+	missing := []string{}
+	for _, fi := range fields.list {
+		if present[fi] || fi.output {
+			continue
+		}
+		if fi.hasDefault {
+			t.setField(n, fi.treeKey(), nil)
+		} else if fi.required {
+			missing = append(missing, fi.treeKey())
+		}
+	}
+	return missing
+}
+
+// defaultValue returns a copy of the default data of the key
+func (t *ObjectType) defaultValue(key string) any {
+	return CloneValue(t.DefaultData[key])
 }
@@ -0,0 +1,678 @@
+package forjitree
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+const (
+	filterOpParam = iota
+	filterOpAnd
+	filterOpOr
+	filterOpNot
+)
+
+// Operators of the filter params, two-character operators go first
+var paramOperators = []struct {
+	op        string
+	paramType int
+}{
+	{"!=", ParamTypeNotEquals},
+	{"^=", ParamTypePrefix},
+	{"$=", ParamTypeSuffix},
+	{"*=", ParamTypeContains},
+	{">=", ParamTypeGreaterOrEquals},
+	{"<=", ParamTypeLessOrEquals},
+	{"=", ParamTypeEquals},
+	{">", ParamTypeGreaterThan},
+	{"<", ParamTypeLessThan},
+	{"~", ParamTypeRegex},
+}
+
+// pathFilter is the boolean expression of a [...] path token, Args are the operands of and, or and not
+type pathFilter struct {
+	Op    int
+	Args  []*pathFilter
+	Param pathTokenParam
+}
+
+// match reports whether the node satisfies the filter
+func (f *pathFilter) match(n *node) bool {
+	switch f.Op {
+	case filterOpAnd:
+		for _, a := range f.Args {
+			if !a.match(n) {
+				return false
+			}
+		}
+		return true
+	case filterOpOr:
+		for _, a := range f.Args {
+			if a.match(n) {
+				return true
+			}
+		}
+		return false
+	case filterOpNot:
+		return !f.Args[0].match(n)
+	}
+	return f.Param.match(n)
+}
+
+// match compares the value of the param key with the param value, missing keys satisfy nothing but absence
+func (p *pathTokenParam) match(n *node) bool {
+	var value any
+	if p.Function != nil {
+		value = p.Function.call(n)
+		if value == nil {
+			return p.ParamType == ParamTypeNotPresence
+		}
+		if p.ParamType == ParamTypePresence {
+			return truthy(value)
+		}
+		if items, isList := value.([]any); isList {
+			return p.matchItems(items)
+		}
+	} else if p.Key == "_key" {
+		value = n.keyValue()
+	} else {
+		n1 := n.getOne(p.Key)
+		if n1 == nil {
+			return p.ParamType == ParamTypeNotPresence
+		}
+		value = n1.getValue()
+	}
+
+	return p.matchValue(value)
+}
+
+// matchItems matches the list returned by a function, any item should match and none for !=
+func (p *pathTokenParam) matchItems(items []any) bool {
+	if p.ParamType == ParamTypeNotEquals {
+		for _, item := range items {
+			if c, ok := compareLiteral(item, p.Value, p.ValueText); ok && c == 0 {
+				return false
+			}
+		}
+		return true
+	}
+	for _, item := range items {
+		if p.matchValue(item) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchValue compares the value with the param value
+func (p *pathTokenParam) matchValue(value any) bool {
+	switch p.ParamType {
+	case ParamTypePresence:
+		return true
+	case ParamTypeNotPresence:
+		return false
+	case ParamTypeIn:
+		for i, v := range p.Values {
+			if c, ok := compareLiteral(value, v, p.ValueTexts[i]); ok && c == 0 {
+				return true
+			}
+		}
+		return false
+	case ParamTypeRegex, ParamTypePrefix, ParamTypeSuffix, ParamTypeContains:
+		s, ok := scalarText(value)
+		if !ok {
+			return false
+		}
+		switch p.ParamType {
+		case ParamTypeRegex:
+			return p.ValueRegex.MatchString(s)
+		case ParamTypePrefix:
+			return strings.HasPrefix(s, p.Value.(string))
+		case ParamTypeSuffix:
+			return strings.HasSuffix(s, p.Value.(string))
+		}
+		return strings.Contains(s, p.Value.(string))
+	}
+
+	c, ok := compareLiteral(value, p.Value, p.ValueText)
+	switch p.ParamType {
+	case ParamTypeEquals:
+		return ok && c == 0
+	case ParamTypeNotEquals:
+		return !ok || c != 0
+	case ParamTypeGreaterThan:
+		return ok && c > 0
+	case ParamTypeLessThan:
+		return ok && c < 0
+	case ParamTypeGreaterOrEquals:
+		return ok && c >= 0
+	case ParamTypeLessOrEquals:
+		return ok && c <= 0
+	}
+	return false
+}
+
+// keyValue returns the key of the node for the _key param, the keys of slice items are numbers
+func (n *node) keyValue() any {
+	if n.parent != nil && n.parent.nodeType == NodeTypeSlice {
+		if i, err := strconv.Atoi(n.parentKey); err == nil {
+			return i
+		}
+	}
+	return n.parentKey
+}
+
+// compareLiteral compares the value with the param literal, strings are compared with the text of unquoted literals
+func compareLiteral(value any, literal any, text string) (int, bool) {
+	if s, isStr := value.(string); isStr && text != "" {
+		return strings.Compare(s, text), true
+	}
+	return compareValues(value, literal)
+}
+
+// compareValues compares two scalar values of the same type, false is returned for values of different types
+func compareValues(a any, b any) (int, bool) {
+	if a == nil || b == nil {
+		return 0, a == nil && b == nil
+	}
+	if fa, ok := toFloat(a); ok {
+		fb, ok := toFloat(b)
+		if !ok {
+			return 0, false
+		}
+		if fa < fb {
+			return -1, true
+		} else if fa > fb {
+			return 1, true
+		}
+		return 0, true
+	}
+	switch av := a.(type) {
+	case string:
+		if bv, ok := b.(string); ok {
+			return strings.Compare(av, bv), true
+		}
+	case bool:
+		if bv, ok := b.(bool); ok {
+			if av == bv {
+				return 0, true
+			} else if bv {
+				return -1, true
+			}
+			return 1, true
+		}
+	}
+	return 0, false
+}
+
+// scalarText returns the text of strings, numbers and booleans
+func scalarText(v any) (string, bool) {
+	if s, ok := v.(string); ok {
+		return s, true
+	}
+	if _, ok := toFloat(v); ok {
+		return fmt.Sprint(v), true
+	}
+	if b, ok := v.(bool); ok {
+		return strconv.FormatBool(b), true
+	}
+	return "", false
+}
+
+// newFilter makes the and/or filter of the args, a single arg is returned as is
+func newFilter(op int, args []*pathFilter) *pathFilter {
+	if len(args) == 1 {
+		return args[0]
+	}
+	return &pathFilter{Op: op, Args: args}
+}
+
+func (p *pathParser) skipSpaces() bool {
+	start := p.pos
+	for !p.eof() && p.peek() == ' ' {
+		p.pos++
+	}
+	return p.pos > start
+}
+
+func (p *pathParser) parseFilter() (pathToken, error) {
+	start := p.pos
+	p.pos++
+	t := pathToken{Kind: PathTokenKindParams}
+
+	f, err := p.parseOr(start)
+	if err != nil {
+		return t, err
+	}
+	if p.eof() {
+		return t, p.errorf(start, "unclosed [")
+	}
+	if p.peek() != ']' {
+		return t, p.errorf(p.pos, "expected , | or ], got %q", p.peek())
+	}
+	p.pos++
+	t.Filter = f
+	return t, nil
+}
+
+func (p *pathParser) parseOr(filterStart int) (*pathFilter, error) {
+	args := []*pathFilter{}
+	for {
+		f, err := p.parseAnd(filterStart)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, f)
+		if p.peek() != '|' {
+			return newFilter(filterOpOr, args), nil
+		}
+		p.pos++
+	}
+}
+
+func (p *pathParser) parseAnd(filterStart int) (*pathFilter, error) {
+	args := []*pathFilter{}
+	for {
+		f, err := p.parseUnary(filterStart)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, f)
+		p.skipSpaces()
+		if p.peek() != ',' {
+			return newFilter(filterOpAnd, args), nil
+		}
+		p.pos++
+	}
+}
+
+func (p *pathParser) parseUnary(filterStart int) (*pathFilter, error) {
+	p.skipSpaces()
+	if p.eof() {
+		return nil, p.errorf(filterStart, "unclosed [")
+	}
+
+	switch c := p.peek(); {
+	case c == '!' && !strings.HasPrefix(p.src[p.pos:], "!="):
+		p.pos++
+		f, err := p.parseUnary(filterStart)
+		if err != nil {
+			return nil, err
+		}
+		return &pathFilter{Op: filterOpNot, Args: []*pathFilter{f}}, nil
+
+	case c == '(':
+		start := p.pos
+		p.pos++
+		f, err := p.parseOr(filterStart)
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() != ')' {
+			return nil, p.errorf(start, "unclosed (")
+		}
+		p.pos++
+		return f, nil
+
+	case c == ',' || c == '|' || c == ']' || c == ')':
+		return nil, p.errorf(p.pos, "missing filter param")
+	}
+
+	return p.parseParam(filterStart)
+}
+
+func (p *pathParser) parseParam(filterStart int) (*pathFilter, error) {
+	param := pathTokenParam{ParamType: ParamTypePresence}
+
+	keyStart := p.pos
+	key, err := p.scanParamKey(filterStart)
+	if err != nil {
+		return nil, err
+	}
+	if p.peek() == '(' && key != "" {
+		param.Function, err = p.parseFunctionCall(keyStart, filterStart)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		if key == "" {
+			return nil, p.errorf(keyStart, "missing param key")
+		}
+		// Param keys are relative paths, they are checked here to report the position in the whole path
+		if _, err := CompilePath(key); err != nil {
+			var syntaxErr *PathSyntaxError
+			if errors.As(err, &syntaxErr) {
+				return nil, p.errorf(keyStart+syntaxErr.Pos, "%s", syntaxErr.Msg)
+			}
+			return nil, err
+		}
+		param.Key = key
+	}
+
+	spaced := p.skipSpaces()
+	if spaced && (strings.HasPrefix(p.src[p.pos:], "in ") || strings.HasPrefix(p.src[p.pos:], "in(")) {
+		p.pos += len("in")
+		p.skipSpaces()
+		param.ParamType = ParamTypeIn
+		param.Values, param.ValueTexts, err = p.parseList(filterStart)
+		if err != nil {
+			return nil, err
+		}
+		return &pathFilter{Param: param}, nil
+	}
+
+	operator := false
+	for _, o := range paramOperators {
+		if strings.HasPrefix(p.src[p.pos:], o.op) {
+			param.ParamType = o.paramType
+			p.pos += len(o.op)
+			operator = true
+			break
+		}
+	}
+	if !operator {
+		return &pathFilter{Param: param}, nil
+	}
+
+	p.skipSpaces()
+	valueStart := p.pos
+
+	// The regex is the rest of the param up to , or ], so it can contain | and parentheses
+	if param.ParamType == ParamTypeRegex {
+		text, _, err := p.scanParamValue(filterStart, true)
+		if err != nil {
+			return nil, err
+		}
+		param.ValueRegex, err = regexp.Compile(text)
+		if err != nil {
+			return nil, p.errorf(valueStart, "invalid regex: %v", err)
+		}
+		param.Value = text
+		return &pathFilter{Param: param}, nil
+	}
+
+	value, text, err := p.parseLiteral(filterStart)
+	if err != nil {
+		return nil, err
+	}
+	param.Value = value
+	if _, isStr := value.(string); !isStr {
+		param.ValueText = text
+	}
+
+	// String operators take the text of the value, e.g. 1.0 is not turned into 1
+	switch param.ParamType {
+	case ParamTypePrefix, ParamTypeSuffix, ParamTypeContains:
+		param.Value, param.ValueText = text, ""
+	}
+	return &pathFilter{Param: param}, nil
+}
+
+// parseFunctionCall reads the name(args) function call up to the matching parenthesis
+func (p *pathParser) parseFunctionCall(start int, filterStart int) (*pathFunctionCall, error) {
+	open := p.pos
+	depth, brackets := 0, 0
+	var quote byte
+loop:
+	for ; !p.eof(); p.pos++ {
+		c := p.peek()
+		switch {
+		case c == '\\':
+			p.pos++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[':
+			brackets++
+		case c == ']':
+			if brackets == 0 {
+				return nil, p.errorf(open, "unclosed (")
+			}
+			brackets--
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+			if depth == 0 {
+				break loop
+			}
+		}
+	}
+	if p.eof() {
+		return nil, p.errorf(filterStart, "unclosed [")
+	}
+	p.pos++
+
+	m := FunctionRegex.FindStringSubmatch(p.src[start:p.pos])
+	if m == nil {
+		return nil, p.errorf(start, "invalid function name %s", p.src[start:strings.IndexByte(p.src[start:], '(')+start])
+	}
+	f, ok := getPathFunction(m[1])
+	if !ok {
+		return nil, p.errorf(start, "unknown function %s", m[1])
+	}
+	args := splitArgs(m[2])
+
+	// The arguments of the built-in functions are relative paths, they are checked like the param keys
+	if f.builtin {
+		argStart := open + 1
+		for _, arg := range args {
+			argStart += strings.Index(p.src[argStart:], arg)
+			if _, err := CompilePath(arg); err != nil {
+				var syntaxErr *PathSyntaxError
+				if errors.As(err, &syntaxErr) {
+					return nil, p.errorf(argStart+syntaxErr.Pos, "%s", syntaxErr.Msg)
+				}
+				return nil, err
+			}
+			argStart += len(arg)
+		}
+	}
+	return &pathFunctionCall{Name: m[1], Args: args, fn: f}, nil
+}
+
+// parseList reads the (value,value,...) list of the in operator
+func (p *pathParser) parseList(filterStart int) ([]any, []string, error) {
+	start := p.pos
+	if p.peek() != '(' {
+		return nil, nil, p.errorf(p.pos, "expected ( after in")
+	}
+	p.pos++
+
+	values := []any{}
+	texts := []string{}
+	for {
+		p.skipSpaces()
+		if p.peek() == ')' && len(values) == 0 {
+			return nil, nil, p.errorf(p.pos, "empty list")
+		}
+		v, text, err := p.parseLiteral(filterStart)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, isStr := v.(string); isStr {
+			text = ""
+		}
+		values = append(values, v)
+		texts = append(texts, text)
+
+		switch p.peek() {
+		case ',':
+			p.pos++
+		case ')':
+			p.pos++
+			return values, texts, nil
+		default:
+			return nil, nil, p.errorf(start, "unclosed (")
+		}
+	}
+}
+
+// scanParamKey reads the raw param key up to an operator, in or a filter delimiter. Spaces inside the key
+// are the part of it, the trailing ones are left to the caller. Nested filters are the part of the key.
+func (p *pathParser) scanParamKey(filterStart int) (string, error) {
+	start := p.pos
+	end := p.pos
+	depth := 0
+	for !p.eof() {
+		c := p.peek()
+		if c == '\\' {
+			if p.pos+1 >= len(p.src) {
+				return "", p.errorf(p.pos, "nothing to escape at the end of the path")
+			}
+			p.pos += 2
+			end = p.pos
+			continue
+		}
+		if depth == 0 && (strings.ContainsRune(",|()]=><~", rune(c)) || p.atOperator() || c == ' ' && p.atIn()) {
+			p.pos = end
+			return p.src[start:end], nil
+		}
+		if c == '[' {
+			depth++
+		} else if c == ']' {
+			depth--
+		}
+		p.pos++
+		if c != ' ' {
+			end = p.pos
+		}
+	}
+	return "", p.errorf(filterStart, "unclosed [")
+}
+
+// atIn reports whether the spaces at the current position are followed by the in operator
+func (p *pathParser) atIn() bool {
+	rest := strings.TrimLeft(p.src[p.pos:], " ")
+	return strings.HasPrefix(rest, "in ") || strings.HasPrefix(rest, "in(")
+}
+
+// atOperator reports whether a filter operator starts at the current position
+func (p *pathParser) atOperator() bool {
+	for _, o := range paramOperators {
+		if strings.HasPrefix(p.src[p.pos:], o.op) {
+			return true
+		}
+	}
+	return false
+}
+
+var numberLiteralRegex = regexp.MustCompile(`^[-+]?(\d+(\.\d*)?|\.\d+)([eE][-+]?\d+)?$`)
+
+// parseLiteral reads the param value and returns it with its text. Unquoted values are numbers, true, false
+// and null if they look like ones, strings otherwise.
+func (p *pathParser) parseLiteral(filterStart int) (any, string, error) {
+	if c := p.peek(); c == '"' || c == '\'' {
+		s, err := p.scanQuoted()
+		if err != nil {
+			return nil, "", err
+		}
+		p.skipSpaces()
+		if !p.eof() && !strings.ContainsRune(",|)]", rune(p.peek())) {
+			return nil, "", p.errorf(p.pos, "unexpected %q after quoted string", p.peek())
+		}
+		return s, s, nil
+	}
+
+	s, escaped, err := p.scanParamValue(filterStart, false)
+	if err != nil {
+		return nil, "", err
+	}
+	if !escaped {
+		switch s {
+		case "true":
+			return true, s, nil
+		case "false":
+			return false, s, nil
+		case "null":
+			return nil, s, nil
+		}
+		if numberLiteralRegex.MatchString(s) {
+			if f, err := strconv.ParseFloat(s, 64); err == nil {
+				return f, s, nil
+			}
+		}
+	}
+	return s, s, nil
+}
+
+// scanQuoted reads the quoted string, \n, \r, \t are the control characters, other escaped characters are kept as is
+func (p *pathParser) scanQuoted() (string, error) {
+	start := p.pos
+	quote := p.peek()
+	p.pos++
+
+	var b strings.Builder
+	for !p.eof() {
+		c := p.peek()
+		p.pos++
+		if c == quote {
+			return b.String(), nil
+		}
+		if c == '\\' {
+			if p.eof() {
+				break
+			}
+			c = p.peek()
+			p.pos++
+			switch c {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			}
+		}
+		b.WriteByte(c)
+	}
+	return "", p.errorf(start, "unclosed string")
+}
+
+// scanParamValue reads the unquoted param value up to a filter delimiter resolving the escapes.
+// Brackets and parentheses in the value should be balanced, trailing spaces are trimmed.
+// A regex ends only at , or ] and only its brackets should be balanced.
+func (p *pathParser) scanParamValue(filterStart int, regex bool) (string, bool, error) {
+	delimiters, openers, closers := ",|)]", "[(", "])"
+	if regex {
+		delimiters, openers, closers = ",]", "[", "]"
+	}
+
+	var b strings.Builder
+	end := 0
+	depth := 0
+	escaped := false
+	for !p.eof() {
+		c := p.peek()
+		if c == '\\' {
+			if p.pos+1 >= len(p.src) {
+				return "", false, p.errorf(p.pos, "nothing to escape at the end of the path")
+			}
+			b.WriteByte(p.src[p.pos+1])
+			end = b.Len()
+			escaped = true
+			p.pos += 2
+			continue
+		}
+		if depth == 0 && strings.ContainsRune(delimiters, rune(c)) {
+			return b.String()[:end], escaped, nil
+		}
+		if strings.IndexByte(openers, c) >= 0 {
+			depth++
+		} else if strings.IndexByte(closers, c) >= 0 {
+			depth--
+		}
+		b.WriteByte(c)
+		if c != ' ' {
+			end = b.Len()
+		}
+		p.pos++
+	}
+	return "", false, p.errorf(filterStart, "unclosed [")
+}
@@ -0,0 +1,243 @@
+package forjitree
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+)
+
+// PathFunction computes a value of the node for the path filters:
+//
+//	/services/*[count(endpoints/*)>2]
+//
+// args are the comma-separated arguments as written in the path, usually relative paths.
+// A nil result satisfies no param but the negated ones, a function without an operator is satisfied
+// by a result other than nil, false, zero, an empty string or an empty list. Params comparing a list
+// are satisfied if any of its items matches.
+//
+// The function is called with the tree locked, so a path is matched against a single state of the tree.
+// The methods of n and of the nodes it returns read the tree without locking, Set, CleanNulls and Publish
+// panic with ErrReadOnly. The function must not call the methods of the tree and of other nodes.
+type PathFunction func(n Node, args []string) any
+
+// pathFunction is a registered function, the built-in ones use the nodes without the exported API
+type pathFunction struct {
+	fn      PathFunction
+	builtin bool
+}
+
+var pathFunctions = struct {
+	sync.RWMutex
+	m map[string]pathFunction
+}{m: map[string]pathFunction{}}
+
+func init() {
+	registerPathFunction("count", pathFunction{fn: pathCount, builtin: true})
+	registerPathFunction("keys", pathFunction{fn: pathKeys, builtin: true})
+	registerPathFunction("sum", pathFunction{fn: pathSum, builtin: true})
+	registerPathFunction("min", pathFunction{fn: pathMin, builtin: true})
+	registerPathFunction("max", pathFunction{fn: pathMax, builtin: true})
+	registerPathFunction("type", pathFunction{fn: pathType, builtin: true})
+	registerPathFunction("exists", pathFunction{fn: pathExists, builtin: true})
+}
+
+// RegisterPathFunction adds the function to the path language or replaces the registered one.
+// Paths are compiled with the functions registered at the moment, so they should be registered on startup.
+// first and last are reserved for the [first()] and [last()] selectors.
+func RegisterPathFunction(name string, f PathFunction) error {
+	if !FunctionRegex.MatchString(name + "()") {
+		return fmt.Errorf("invalid path function name %q", name)
+	}
+	if name == "first" || name == "last" {
+		return fmt.Errorf("path function name %q is reserved", name)
+	}
+	registerPathFunction(name, pathFunction{fn: f})
+
+	// Paths using the function could have been cached as invalid
+	clearPathCache()
+	return nil
+}
+
+func registerPathFunction(name string, f pathFunction) {
+	pathFunctions.Lock()
+	defer pathFunctions.Unlock()
+
+	pathFunctions.m[name] = f
+}
+
+func getPathFunction(name string) (pathFunction, bool) {
+	pathFunctions.RLock()
+	defer pathFunctions.RUnlock()
+
+	f, ok := pathFunctions.m[name]
+	return f, ok
+}
+
+// pathFunctionCall is a function param of a filter
+type pathFunctionCall struct {
+	Name string
+	Args []string
+	fn   pathFunction
+}
+
+// call computes the function for the node, the tree of the node must be locked
+func (c *pathFunctionCall) call(n *node) any {
+	if c.fn.builtin {
+		return c.fn.fn(n, c.Args)
+	}
+	return c.fn.fn(lockedNode{n}, c.Args)
+}
+
+// splitArgs splits the function arguments by the commas which are not enclosed in brackets, parentheses or quotes
+func splitArgs(s string) []string {
+	if strings.TrimSpace(s) == "" {
+		return nil
+	}
+	args := []string{}
+	depth := 0
+	var quote byte
+	start := 0
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\':
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '[' || c == '(':
+			depth++
+		case c == ']' || c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			args = append(args, strings.TrimSpace(s[start:i]))
+			start = i + 1
+		}
+	}
+	return append(args, strings.TrimSpace(s[start:]))
+}
+
+// truthy reports whether the function result satisfies a param without an operator
+func truthy(v any) bool {
+	if f, isNumber := toFloat(v); isNumber {
+		return f != 0
+	}
+	switch v := v.(type) {
+	case nil:
+		return false
+	case bool:
+		return v
+	case string:
+		return v != ""
+	case []any:
+		return len(v) > 0
+	}
+	return true
+}
+
+// functionTarget returns the node the function is applied to, the first match of the optional path argument
+func functionTarget(n Node, args []string) *node {
+	if len(args) == 0 {
+		return n.internalNode()
+	}
+	return n.internalNode().getOne(args[0])
+}
+
+// functionNumbers returns the numbers of the nodes matching the path argument, slices add their items
+func functionNumbers(n Node, args []string) []float64 {
+	if len(args) != 1 {
+		return nil
+	}
+	numbers := []float64{}
+	for _, n1 := range n.internalNode().getEx(args[0], true, true, true) {
+		values := []any{n1.getValue()}
+		if sl, isSlice := values[0].([]any); isSlice {
+			values = sl
+		}
+		for _, v := range values {
+			if f, isNumber := toFloat(v); isNumber {
+				numbers = append(numbers, f)
+			}
+		}
+	}
+	return numbers
+}
+
+// pathCount returns the number of the nodes matching the path, of the children without arguments
+func pathCount(n Node, args []string) any {
+	if len(args) == 0 {
+		return len(n.internalNode().getChildren(false))
+	}
+	if len(args) > 1 {
+		return nil
+	}
+	return len(n.internalNode().getEx(args[0], true, true, true))
+}
+
+// pathKeys returns the keys of the children of the node or of the node at the path
+func pathKeys(n Node, args []string) any {
+	target := functionTarget(n, args)
+	if target == nil || len(args) > 1 {
+		return nil
+	}
+	keys := []any{}
+	for _, child := range target.getChildren(false) {
+		keys = append(keys, child.keyValue())
+	}
+	return keys
+}
+
+func pathSum(n Node, args []string) any {
+	if len(args) != 1 {
+		return nil
+	}
+	sum := 0.0
+	for _, f := range functionNumbers(n, args) {
+		sum += f
+	}
+	return sum
+}
+
+func pathMin(n Node, args []string) any {
+	numbers := functionNumbers(n, args)
+	if len(numbers) == 0 {
+		return nil
+	}
+	result := math.Inf(1)
+	for _, f := range numbers {
+		result = math.Min(result, f)
+	}
+	return result
+}
+
+func pathMax(n Node, args []string) any {
+	numbers := functionNumbers(n, args)
+	if len(numbers) == 0 {
+		return nil
+	}
+	result := math.Inf(-1)
+	for _, f := range numbers {
+		result = math.Max(result, f)
+	}
+	return result
+}
+
+// pathType returns the object type name of the node or of the node at the path
+func pathType(n Node, args []string) any {
+	target := functionTarget(n, args)
+	if target == nil || target.objType == nil || len(args) > 1 {
+		return nil
+	}
+	return target.objType.Name
+}
+
+func pathExists(n Node, args []string) any {
+	if len(args) != 1 {
+		return nil
+	}
+	return len(n.internalNode().getEx(args[0], true, true, true)) > 0
+}
@@ -1,9 +1,13 @@
 package forjitree
 
 import (
-	"encoding/csv"
+	"container/list"
+	"fmt"
+	"log"
 	"regexp"
+	"strconv"
 	"strings"
+	"sync"
 )
 
 const (
@@ -15,173 +19,407 @@ const (
 	PathTokenKindDirectChildren
 	PathTokenKindAllChildren
 	PathTokenKindAllParents
+	PathTokenKindIndex
 )
 
 const (
 	ParamTypeEquals = iota
 	ParamTypePresence
 	ParamTypeNotEquals
+	// Deprecated: !key is compiled into the negation of ParamTypePresence
 	ParamTypeNotPresence
 	ParamTypeGreaterThan
 	ParamTypeLessThan
 	ParamTypeGreaterOrEquals
 	ParamTypeLessOrEquals
 	ParamTypeRegex
+	ParamTypeIn
+	ParamTypePrefix
+	ParamTypeSuffix
+	ParamTypeContains
 )
 
+// pathCacheSize is the number of compiled paths kept by GetEx, the least recently used ones are dropped
+const pathCacheSize = 1024
+
+// pathTokenParam is a filter param, Value and Values are literals: float64, string, bool or nil.
+// ValueText and ValueTexts are the source texts of the unquoted literals which are not strings, empty otherwise.
+// The value of Function is compared instead of the value at Key if it is set.
 type pathTokenParam struct {
 	Key        string
-	Value      string
+	Value      any
+	ValueText  string
 	ParamType  int
 	ValueRegex *regexp.Regexp
+	Values     []any
+	ValueTexts []string
+	Function   *pathFunctionCall
 }
 
 type pathToken struct {
 	Kind   int
 	Key    string
-	Params []pathTokenParam
+	Filter *pathFilter
+	Index  *pathIndex
 }
 
-func splitCSV(s string, delimeter rune) []string {
-	r := csv.NewReader(strings.NewReader(s))
-	r.Comma = delimeter
-	record, err := r.Read()
-	if err != nil {
-		return nil
-	}
-	return record
+// pathIndex is a [#start] or [#start:end] selector of the slice items or a [first()], [last()], [first(n)] or [last(n)]
+// selector of the matched nodes, negative positions count from the end. Items is set for the slice item selectors.
+type pathIndex struct {
+	Start   int
+	End     int
+	Range   bool
+	OpenEnd bool
+	Items   bool
 }
 
-func TokenizePath(path string) []pathToken {
-	const subToken rune = '/'
-	const paramsToken rune = '['
-	const paramsCloseToken rune = ']'
-	const escapeToken rune = '\\'
-
-	var paramsTokenCounter = 0
-	var tokensStr []string
-	t := ""
-	for i := 0; i < len(path); i++ {
-
-		// Escape token
-		if rune(path[i]) == escapeToken {
-			i++
-			if i >= len(path) {
-				break
-			}
-			t += string(path[i])
-			continue
+// apply returns the selected nodes, positions out of the range select nothing
+func (i *pathIndex) apply(nodes []*node) []*node {
+	resolve := func(pos int) int {
+		if pos < 0 {
+			pos += len(nodes)
 		}
+		return min(max(pos, 0), len(nodes))
+	}
 
-		if rune(path[i]) == subToken && paramsTokenCounter == 0 {
-			tokensStr = append(tokensStr, t)
-			t = ""
-
-		} else if rune(path[i]) == paramsToken {
-			if paramsTokenCounter == 0 {
-				tokensStr = append(tokensStr, t)
-				t = ""
-			}
-			paramsTokenCounter++
-
-		} else if rune(path[i]) == paramsCloseToken {
-			paramsTokenCounter--
+	if !i.Range {
+		pos := i.Start
+		if pos < 0 {
+			pos += len(nodes)
+		}
+		if pos < 0 || pos >= len(nodes) {
+			return nil
 		}
+		return []*node{nodes[pos]}
+	}
 
-		t += string(path[i])
+	start, end := resolve(i.Start), len(nodes)
+	if !i.OpenEnd {
+		end = resolve(i.End)
+	}
+	if start >= end {
+		return nil
 	}
-	tokensStr = append(tokensStr, t)
+	return append([]*node{}, nodes[start:end]...)
+}
 
-	var tokens []pathToken
-	for i, ts := range tokensStr {
-		var t pathToken
-		t.Kind = PathTokenKindThis
+// Path is a compiled path expression:
+//
+//	/services/*[object=Http,port>=8080]/name
+//
+// Steps are separated by /, a leading / starts from the root. A step is a key, .. (parent), ... (all parents),
+// * (direct children) or ** (all children), followed by any number of [...] filters and selectors.
+// Children are matched in order, map keys are sorted, ** goes depth-first.
+//
+//	[object=Http|object=Https]  [!(enabled=false),port>1024]  [env in (prod,stage)]
+//
+// [#0], [#-1] (the last one), [#1:3] (end exclusive), [#1:] and [#:2] select the items of the matched slices,
+// e.g. /items[#0] is the first item of /items. [first()], [last()], [first(n)] and [last(n)] (the first or the last
+// n nodes) select from all nodes matched so far, e.g. **[object=Http][first()] is the first Http object
+// and *[first(3)][last(2)] are the second and the third children.
+//
+// A filter param is a key (presence) or a key followed by an operator and a value, or by in and a list of values.
+// Param keys are paths relative to the filtered node, spaces inside them are the part of the key.
+// _key is the key of the node (the index of slice items).
+// Params are combined with , (and), | (or), ! (not) and parentheses, , binds tighter than |.
+//
+// A function call can be used instead of a key, e.g. [count(endpoints/*)>2], see PathFunction.
+// Built-in functions: count(path), keys(path), sum(path), min(path), max(path), type(path) and exists(path),
+// count, keys and type apply to the filtered node itself without the argument.
+//
+// Values are numbers, true, false, null, quoted strings ("..." or '...' with \ escapes) or unquoted strings.
+// =, !=, >, <, >= and <= compare numbers with numbers, strings with strings, booleans with booleans and null
+// with null, values of different types are never equal. Only quoted strings are strictly typed: unquoted numbers,
+// true, false and null are compared with strings by their text, so [port=8080] matches "8080" and [_key=0]
+// matches the map key "0", while [port='8080'] doesn't match 8080. ^= (prefix), $= (suffix), *= (contains) and ~ (regex)
+// match the text of strings, numbers and booleans. The regex after ~ is the rest of the param up to , or ],
+// e.g. [name~^(a|b)$]. Spaces around params and operators are ignored, \ escapes the next character outside
+// of quoted strings.
+type Path struct {
+	source string
+	tokens []pathToken
+}
 
-		if ts == "" && i == 0 && len(tokensStr) > 1 && strings.HasPrefix(tokensStr[1], "/") {
-			t.Kind = PathTokenKindRoot
+func (p *Path) String() string {
+	return p.source
+}
 
-		} else if (ts == ".." && i == 0) || ts == "/.." {
-			t.Kind = PathTokenKindParent
+// PathSyntaxError is returned by CompilePath for invalid paths, Pos is the byte offset of the error in the path
+type PathSyntaxError struct {
+	Path string
+	Pos  int
+	Msg  string
+}
 
-		} else if (ts == "..." && i == 0) || ts == "/..." {
-			t.Kind = PathTokenKindAllParents
+func (e *PathSyntaxError) Error() string {
+	return fmt.Sprintf("invalid path %q at position %d: %s", e.Path, e.Pos, e.Msg)
+}
 
-		} else if (ts == "*" && i == 0) || ts == "/*" {
-			t.Kind = PathTokenKindDirectChildren
+// CompilePath parses the path expression, see Path for the syntax
+func CompilePath(path string) (*Path, error) {
+	p := &pathParser{src: path}
+	tokens, err := p.parsePath()
+	if err != nil {
+		return nil, err
+	}
+	return &Path{source: path, tokens: tokens}, nil
+}
 
-		} else if (ts == "**" && i == 0) || ts == "/**" {
-			t.Kind = PathTokenKindAllChildren
+// MustCompilePath is like CompilePath but panics if the path is invalid. It is intended for static paths.
+func MustCompilePath(path string) *Path {
+	p, err := CompilePath(path)
+	if err != nil {
+		panic(err)
+	}
+	return p
+}
 
-		} else if strings.HasPrefix(ts, "[") && strings.HasSuffix(ts, "]") {
-			// [key=value,key] filter token
-			t.Kind = PathTokenKindParams
-			pairs := splitCSV(strings.Trim(ts, "[]"), ',')
-			for _, p := range pairs {
+// TokenizePath returns the tokens of the path or nil if the path is invalid, the syntax error is logged.
+//
+// Deprecated: use CompilePath, which reports syntax errors.
+func TokenizePath(path string) []pathToken {
+	p, err := compilePathCached(path)
+	if err != nil {
+		return nil
+	}
+	return p.tokens
+}
 
-				if strings.Contains(p, "=") {
-					// Value equation
-					dividerPos := strings.Index(p, "=")
-					t.Params = append(t.Params, pathTokenParam{Key: p[:dividerPos], Value: p[dividerPos+1:], ParamType: ParamTypeEquals})
+type pathCacheEntry struct {
+	source string
+	path   *Path
+	err    error
+}
 
-				} else if strings.Contains(p, "!=") {
-					// Value not equals
-					dividerPos := strings.Index(p, "!=")
-					t.Params = append(t.Params, pathTokenParam{Key: p[:dividerPos], Value: p[dividerPos+2:], ParamType: ParamTypeNotEquals})
+// pathCache keeps the recently used paths, the front of the list is the most recent one
+var pathCache = struct {
+	sync.Mutex
+	m     map[string]*list.Element
+	order *list.List
+}{m: map[string]*list.Element{}, order: list.New()}
+
+// compilePathCached compiles the path once, the syntax errors are cached as well and logged when the path is compiled
+func compilePathCached(path string) (*Path, error) {
+	pathCache.Lock()
+	if el, ok := pathCache.m[path]; ok {
+		pathCache.order.MoveToFront(el)
+		e := el.Value.(*pathCacheEntry)
+		pathCache.Unlock()
+		return e.path, e.err
+	}
+	pathCache.Unlock()
 
-				} else if strings.Contains(p, ">") {
-					// Value greater than
-					dividerPos := strings.Index(p, ">")
-					t.Params = append(t.Params, pathTokenParam{Key: p[:dividerPos], Value: p[dividerPos+1:], ParamType: ParamTypeGreaterThan})
+	p, err := CompilePath(path)
+	if err != nil {
+		log.Printf("forjitree: %v", err)
+	}
 
-				} else if strings.Contains(p, "<") {
-					// Value less than
-					dividerPos := strings.Index(p, "<")
-					t.Params = append(t.Params, pathTokenParam{Key: p[:dividerPos], Value: p[dividerPos+1:], ParamType: ParamTypeLessThan})
+	pathCache.Lock()
+	defer pathCache.Unlock()
+	if el, ok := pathCache.m[path]; ok {
+		pathCache.order.MoveToFront(el)
+		return p, err
+	}
+	pathCache.m[path] = pathCache.order.PushFront(&pathCacheEntry{source: path, path: p, err: err})
+	if pathCache.order.Len() > pathCacheSize {
+		oldest := pathCache.order.Back()
+		pathCache.order.Remove(oldest)
+		delete(pathCache.m, oldest.Value.(*pathCacheEntry).source)
+	}
+	return p, err
+}
 
-				} else if strings.Contains(p, ">=") {
-					// Value greater or equals
-					dividerPos := strings.Index(p, ">=")
-					t.Params = append(t.Params, pathTokenParam{Key: p[:dividerPos], Value: p[dividerPos+2:], ParamType: ParamTypeGreaterOrEquals})
+// clearPathCache drops all compiled paths
+func clearPathCache() {
+	pathCache.Lock()
+	defer pathCache.Unlock()
 
-				} else if strings.Contains(p, "<=") {
-					// Value less or equals
-					dividerPos := strings.Index(p, "<=")
-					t.Params = append(t.Params, pathTokenParam{Key: p[:dividerPos], Value: p[dividerPos+2:], ParamType: ParamTypeLessOrEquals})
+	pathCache.m = map[string]*list.Element{}
+	pathCache.order.Init()
+}
 
-				} else if strings.Contains(p, "~") {
-					// Value regex
-					dividerPos := strings.Index(p, "~")
-					valueRegex, err := regexp.Compile(p[dividerPos+1:])
-					if err != nil {
-						t.Params = append(t.Params, pathTokenParam{Key: p[:dividerPos], ValueRegex: valueRegex, ParamType: ParamTypeRegex})
-					}
+type pathParser struct {
+	src string
+	pos int
+}
 
-				} else if strings.HasPrefix(p, "!") {
-					// Check for key absence
-					t.Params = append(t.Params, pathTokenParam{Key: p[1:], Value: "", ParamType: ParamTypeNotPresence})
+func (p *pathParser) errorf(pos int, format string, args ...any) error {
+	return &PathSyntaxError{Path: p.src, Pos: pos, Msg: fmt.Sprintf(format, args...)}
+}
 
-				} else {
-					// Check for key presense
-					t.Params = append(t.Params, pathTokenParam{Key: p, Value: "", ParamType: ParamTypePresence})
-				}
+func (p *pathParser) eof() bool {
+	return p.pos >= len(p.src)
+}
 
+func (p *pathParser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *pathParser) parsePath() ([]pathToken, error) {
+	tokens := []pathToken{}
+	for first := true; ; first = false {
+		key, literal, err := p.parseKey()
+		if err != nil {
+			return nil, err
+		}
+		if p.peek() == ']' {
+			return nil, p.errorf(p.pos, "unexpected ]")
+		}
+		step := p.stepToken(key, literal, first)
+		tokens = append(tokens, step)
+
+		for p.peek() == '[' {
+			t, isIndex, err := p.parseIndex()
+			if err == nil && !isIndex {
+				t, err = p.parseFilter()
 			}
+			if err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, t)
+		}
 
-		} else if strings.HasPrefix(ts, "/") {
-			if len(ts) > 1 {
-				t.Kind = PathTokenKindSub
-				t.Key = strings.TrimPrefix(ts, "/")
+		if p.eof() {
+			return tokens, nil
+		}
+		if p.peek() != '/' {
+			return nil, p.errorf(p.pos, "expected / or [ after ], got %q", p.peek())
+		}
+		p.pos++
+	}
+}
+
+// parseIndex reads the position selector, false is returned if the brackets contain a filter
+func (p *pathParser) parseIndex() (pathToken, bool, error) {
+	start := p.pos
+	p.pos++
+	p.skipSpaces()
+	t := pathToken{Kind: PathTokenKindIndex, Index: &pathIndex{}}
+
+	switch {
+	case strings.HasPrefix(p.src[p.pos:], "first("), strings.HasPrefix(p.src[p.pos:], "last("):
+		last := p.peek() == 'l'
+		p.pos += strings.IndexByte(p.src[p.pos:], '(') + 1
+		p.skipSpaces()
+		if last {
+			t.Index.Start = -1
+		}
+		if p.peek() != ')' {
+			countStart := p.pos
+			count, err := p.parseInt()
+			if err != nil || count < 0 {
+				return t, true, p.errorf(countStart, "expected a count")
+			}
+			// first(n) and last(n) take the range of n nodes
+			t.Index.Range = true
+			if last {
+				t.Index.Start, t.Index.OpenEnd = -count, true
 			} else {
-				t.Kind = PathTokenKindThis
+				t.Index.End = count
 			}
-
-		} else if i == 0 && ts != "" {
-			t.Kind = PathTokenKindSub
-			t.Key = ts
+			if count == 0 {
+				t.Index.Start, t.Index.End, t.Index.OpenEnd = 0, 0, false
+			}
+			p.skipSpaces()
+		}
+		if p.peek() != ')' {
+			return t, true, p.errorf(p.pos, "expected ), got %q", p.peek())
 		}
+		p.pos++
+	case p.peek() == '#':
+		p.pos++
+		t.Index.Items = true
+		var err error
+		if p.peek() != ':' {
+			if t.Index.Start, err = p.parseInt(); err != nil {
+				return t, true, err
+			}
+		}
+		if p.peek() == ':' {
+			p.pos++
+			t.Index.Range = true
+			t.Index.OpenEnd = p.peek() == ']' || p.peek() == ' '
+			if !t.Index.OpenEnd {
+				if t.Index.End, err = p.parseInt(); err != nil {
+					return t, true, err
+				}
+			}
+		}
+	default:
+		p.pos = start
+		return t, false, nil
+	}
+
+	p.skipSpaces()
+	if p.eof() {
+		return t, true, p.errorf(start, "unclosed [")
+	}
+	if p.peek() != ']' {
+		return t, true, p.errorf(p.pos, "expected ], got %q", p.peek())
+	}
+	p.pos++
+	return t, true, nil
+}
+
+func (p *pathParser) parseInt() (int, error) {
+	start := p.pos
+	if p.peek() == '-' {
+		p.pos++
+	}
+	for !p.eof() && p.peek() >= '0' && p.peek() <= '9' {
+		p.pos++
+	}
+	i, err := strconv.Atoi(p.src[start:p.pos])
+	if err != nil {
+		return 0, p.errorf(start, "expected a position")
+	}
+	return i, nil
+}
 
-		tokens = append(tokens, t)
+// stepToken makes the token of the step key, escaped keys are never special
+func (p *pathParser) stepToken(key string, literal bool, first bool) pathToken {
+	if !literal {
+		switch key {
+		case "":
+			if first && p.peek() == '/' {
+				return pathToken{Kind: PathTokenKindRoot}
+			}
+			return pathToken{Kind: PathTokenKindThis}
+		case "..":
+			return pathToken{Kind: PathTokenKindParent}
+		case "...":
+			return pathToken{Kind: PathTokenKindAllParents}
+		case "*":
+			return pathToken{Kind: PathTokenKindDirectChildren}
+		case "**":
+			return pathToken{Kind: PathTokenKindAllChildren}
+		}
 	}
+	return pathToken{Kind: PathTokenKindSub, Key: key}
+}
 
-	return tokens
+// parseKey reads the step key up to the next /, [ or ]
+func (p *pathParser) parseKey() (string, bool, error) {
+	var b strings.Builder
+	literal := false
+	for !p.eof() {
+		c := p.peek()
+		if c == '/' || c == '[' || c == ']' {
+			break
+		}
+		if c == '\\' {
+			if p.pos+1 >= len(p.src) {
+				return "", false, p.errorf(p.pos, "nothing to escape at the end of the path")
+			}
+			literal = true
+			p.pos++
+			c = p.peek()
+		}
+		b.WriteByte(c)
+		p.pos++
+	}
+	return b.String(), literal, nil
 }
@@ -1,7 +1,12 @@
 package forjitree
 
 import (
+	"bytes"
+	"errors"
+	"fmt"
+	"log"
 	"reflect"
+	"sort"
 	"testing"
 )
 
@@ -57,12 +62,11 @@ func TestTokenizePath(t *testing.T) {
 				},
 				{
 					Kind: PathTokenKindParams,
-					Params: []pathTokenParam{
-						{
-							"key",
-							"value",
-							ParamTypeEquals,
-							nil,
+					Filter: &pathFilter{
+						Param: pathTokenParam{
+							Key:       "key",
+							Value:     "value",
+							ParamType: ParamTypeEquals,
 						},
 					},
 				},
@@ -81,12 +85,11 @@ func TestTokenizePath(t *testing.T) {
 				},
 				{
 					Kind: PathTokenKindParams,
-					Params: []pathTokenParam{
-						{
-							"key/subkey",
-							"value",
-							ParamTypeEquals,
-							nil,
+					Filter: &pathFilter{
+						Param: pathTokenParam{
+							Key:       "key/subkey",
+							Value:     "value",
+							ParamType: ParamTypeEquals,
 						},
 					},
 				},
@@ -101,3 +104,420 @@ func TestTokenizePath(t *testing.T) {
 		})
 	}
 }
+
+func TestCompilePath(t *testing.T) {
+	param := func(key string, paramType int, value any) *pathFilter {
+		return &pathFilter{Param: pathTokenParam{Key: key, Value: value, ParamType: paramType}}
+	}
+	literal := func(key string, paramType int, value any, text string) *pathFilter {
+		return &pathFilter{Param: pathTokenParam{Key: key, Value: value, ValueText: text, ParamType: paramType}}
+	}
+	tests := []struct {
+		path string
+		want *pathFilter
+	}{
+		{"[a!=b]", param("a", ParamTypeNotEquals, "b")},
+		{"[a>=1]", literal("a", ParamTypeGreaterOrEquals, 1.0, "1")},
+		{"[a<=-1.5e2]", literal("a", ParamTypeLessOrEquals, -150.0, "-1.5e2")},
+		{"[a=true]", literal("a", ParamTypeEquals, true, "true")},
+		{"[a=null]", literal("a", ParamTypeEquals, nil, "null")},
+		{"[a='1']", param("a", ParamTypeEquals, "1")},
+		{"[a=1.0.0]", param("a", ParamTypeEquals, "1.0.0")},
+		{"[a=\\true]", param("a", ParamTypeEquals, "true")},
+		{`[a = "x,\"y\"\n" ]`, param("a", ParamTypeEquals, "x,\"y\"\n")},
+		{"[a^=1.0]", param("a", ParamTypePrefix, "1.0")},
+		{"[a$=x]", param("a", ParamTypeSuffix, "x")},
+		{"[a*='b c']", param("a", ParamTypeContains, "b c")},
+		{"[a[b=1]=c\\,d]", param("a[b=1]", ParamTypeEquals, "c,d")},
+		{"[a,!b]", &pathFilter{Op: filterOpAnd, Args: []*pathFilter{
+			param("a", ParamTypePresence, nil),
+			{Op: filterOpNot, Args: []*pathFilter{param("b", ParamTypePresence, nil)}},
+		}}},
+		{"[a=1,b=2|c]", &pathFilter{Op: filterOpOr, Args: []*pathFilter{
+			{Op: filterOpAnd, Args: []*pathFilter{literal("a", ParamTypeEquals, 1.0, "1"), literal("b", ParamTypeEquals, 2.0, "2")}},
+			param("c", ParamTypePresence, nil),
+		}}},
+		{"[ !( a = x y | b ) ]", &pathFilter{Op: filterOpNot, Args: []*pathFilter{
+			{Op: filterOpOr, Args: []*pathFilter{param("a", ParamTypeEquals, "x y"), param("b", ParamTypePresence, nil)}},
+		}}},
+		{"[env in (prod, stage)]", &pathFilter{Param: pathTokenParam{Key: "env", ParamType: ParamTypeIn, Values: []any{"prod", "stage"}, ValueTexts: []string{"", ""}}}},
+		{"[my key=x]", param("my key", ParamTypeEquals, "x")},
+		{"[my\\ key ]", param("my\\ key", ParamTypePresence, nil)},
+		{"[n in (1, 'a', null)]", &pathFilter{Param: pathTokenParam{Key: "n", ParamType: ParamTypeIn, Values: []any{1.0, "a", nil}, ValueTexts: []string{"1", "", "null"}}}},
+	}
+	for _, tt := range tests {
+		p, err := CompilePath(tt.path)
+		if err != nil {
+			t.Fatalf("CompilePath(%q): %v", tt.path, err)
+		}
+		if got := p.tokens[len(p.tokens)-1].Filter; !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("CompilePath(%q) filter = %+v, want %+v", tt.path, got, tt.want)
+		}
+	}
+
+	p := MustCompilePath("[name~^a[0-9]+$]")
+	if re := p.tokens[1].Filter.Param.ValueRegex; re == nil || !re.MatchString("a12") {
+		t.Errorf("regex param is not compiled: %+v", p.tokens[1].Filter.Param)
+	}
+
+	errorTests := []struct {
+		path string
+		pos  int
+	}{
+		{"a[b=1", 1},
+		{"a]", 1},
+		{"a[]", 2},
+		{"a[b,]", 4},
+		{"a[=1]", 2},
+		{"a[b~(]", 4},
+		{"a[b]c", 4},
+		{"a\\", 1},
+		{"a[b]]/c", 4},
+		{"a[b[c~(]]", 6},
+		{"a[(b|c]", 2},
+		{"a[b|]", 4},
+		{"a[b in ()]", 8},
+		{"a[b in (c]", 7},
+		{"a[b=\"c]", 4},
+		{"a[b='c'd]", 7},
+	}
+	for _, tt := range errorTests {
+		_, err := CompilePath(tt.path)
+		var syntaxErr *PathSyntaxError
+		if !errors.As(err, &syntaxErr) {
+			t.Errorf("CompilePath(%q) error = %v, want a syntax error", tt.path, err)
+			continue
+		}
+		if syntaxErr.Pos != tt.pos {
+			t.Errorf("CompilePath(%q) error = %v, want position %d", tt.path, err, tt.pos)
+		}
+	}
+}
+
+func TestGetCompiledPath(t *testing.T) {
+	tree := New()
+	tree.Set(map[string]any{
+		"items": map[string]any{
+			"a": map[string]any{"name": "alpha", "size": 1},
+			"b": map[string]any{"name": "beta", "size": 2},
+			"c": map[string]any{"name": "gamma", "size": 3},
+		},
+	})
+
+	count := func(path string) int {
+		return len(tree.Root().Get(path))
+	}
+	if n := count("/items/*[size>=2]"); n != 2 {
+		t.Errorf("size>=2 matched %d nodes, want 2", n)
+	}
+	if n := count("/items/*[size<=2]"); n != 2 {
+		t.Errorf("size<=2 matched %d nodes, want 2", n)
+	}
+	if n := count("/items/*[name!=beta]"); n != 2 {
+		t.Errorf("name!=beta matched %d nodes, want 2", n)
+	}
+	if n := count("/items/*[name~^(alpha|gamma)$]"); n != 2 {
+		t.Errorf("name regex matched %d nodes, want 2", n)
+	}
+	if n := count("/items/*[name=alpha|size>2]"); n != 2 {
+		t.Errorf("or matched %d nodes, want 2", n)
+	}
+	if n := count("/items/*[!(name=alpha|size>2)]"); n != 1 {
+		t.Errorf("not matched %d nodes, want 1", n)
+	}
+	if n := count("/items/*[name in (alpha,beta),size!=1]"); n != 1 {
+		t.Errorf("in matched %d nodes, want 1", n)
+	}
+	if n := count("/items/*[_key in (a,c)]"); n != 2 {
+		t.Errorf("_key in matched %d nodes, want 2", n)
+	}
+	if n := count("/items/*[name^=al|name$=ta]"); n != 2 {
+		t.Errorf("prefix or suffix matched %d nodes, want 2", n)
+	}
+	if n := count("/items/*[name*=mm]"); n != 1 {
+		t.Errorf("contains matched %d nodes, want 1", n)
+	}
+	if n := count("/items/*[name=beta"); n != 0 {
+		t.Errorf("invalid path matched %d nodes, want 0", n)
+	}
+
+	p := MustCompilePath("items/*[size>1]/name")
+	if nodes := tree.Root().GetPath(p); len(nodes) != 2 {
+		t.Errorf("GetPath matched %d nodes, want 2", len(nodes))
+	}
+}
+
+func TestGetLinkDuplicates(t *testing.T) {
+	tree := New()
+	tree.Set(map[string]any{
+		"a": "@x/p",
+		"b": "@x/*",
+		"x": map[string]any{"p": 1, "q": 2},
+	})
+
+	// The nodes of a link after the one matched before are kept
+	got := []any{}
+	for _, n := range tree.Root().Get("*") {
+		got = append(got, n.Path())
+	}
+	if want := []any{"/x/p", "/x/q", "/x"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Get() = %v, want %v", got, want)
+	}
+}
+
+func TestTypedPathFilters(t *testing.T) {
+	tree := New()
+	tree.Set(map[string]any{
+		"a":    map[string]any{"count": 1.0, "enabled": true, "version": "1.0", "note": nil},
+		"b":    map[string]any{"count": 1, "enabled": false, "version": "1.10", "note": "x, \"y\""},
+		"c":    map[string]any{"count": "1", "enabled": "false", "version": 10},
+		"list": []any{"x", "y", "z"},
+	})
+
+	tests := []struct {
+		filter string
+		want   []string
+	}{
+		{"[count=1]", []string{"a", "b", "c"}},
+		{"[count='1']", []string{"c"}},
+		{"[count!=1]", []string{}},
+		{"[count!='1']", []string{"a", "b"}},
+		{"[count=1.0]", []string{"a", "b"}},
+		{"[enabled=false]", []string{"b", "c"}},
+		{"[enabled='false']", []string{"c"}},
+		{"[note=null]", []string{"a"}},
+		{"[note=\"x, \\\"y\\\"\"]", []string{"b"}},
+		{"[version>'1.1']", []string{"b"}},
+		{"[version>1]", []string{"a", "b", "c"}},
+		{"[version>9]", []string{"c"}},
+		{"[version^=1.1]", []string{"b"}},
+		{"[version^=1]", []string{"a", "b", "c"}},
+		{"[count in (1,'1')]", []string{"a", "b", "c"}},
+	}
+	for _, tt := range tests {
+		got := []string{}
+		for _, n := range tree.Root().Get("*" + tt.filter) {
+			got = append(got, n.Name())
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s matched %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+
+	if nodes := tree.Root().Get("list/*[_key>=1]"); len(nodes) != 2 {
+		t.Errorf("_key>=1 matched %d slice items, want 2", len(nodes))
+	}
+
+	// Unquoted literals are compared with strings by their text
+	tree.Set(map[string]any{"services": map[string]any{
+		"0": map[string]any{"port": "8080", "id": "007", "name": "a", "my key": 1},
+		"1": map[string]any{"port": 8080, "id": 7, "name": "b"},
+	}})
+	for path, want := range map[string]int{
+		"services/*[_key=0]":      1,
+		"services/*[port=8080]":   2,
+		"services/*[port='8080']": 1,
+		"services/*[id=007]":      2,
+		"services/*[id='007']":    1,
+		"services/*[id in (007)]": 2,
+
+		"services/*[name~a|b]":        2,
+		"services/*[name~^(a|c)$,id]": 1,
+		"services/*[port~8080|9090]":  2,
+		"services/*[my key=1]":        1,
+		"services/*[ my key ]":        1,
+		"services/*[!my key|name=b]":  1,
+	} {
+		if nodes := tree.Root().Get(path); len(nodes) != want {
+			t.Errorf("%s matched %d nodes, want %d", path, len(nodes), want)
+		}
+	}
+}
+
+func TestPathIndex(t *testing.T) {
+	tree := New()
+	tree.Set(map[string]any{
+		"items": []any{"a", "b", "c", "d"},
+		"services": map[string]any{
+			"web":   map[string]any{"port": 80, "tags": []any{"x", "y"}},
+			"api":   map[string]any{"port": 8080, "tags": []any{"z"}},
+			"cache": map[string]any{"port": 6379},
+		},
+	})
+
+	tests := []struct {
+		path string
+		want []any
+	}{
+		{"/items[#0]", []any{"a"}},
+		{"/items[#-1]", []any{"d"}},
+		{"/items[#1:3]", []any{"b", "c"}},
+		{"/items[#2:]", []any{"c", "d"}},
+		{"/items[#:-3]", []any{"a"}},
+		{"/items[#4]", []any{}},
+		{"/items/*[last()]", []any{"d"}},
+		{"/items/*[#1]", []any{}},
+		{"/items/*[_key>0][first()]", []any{"b"}},
+		{"/services/*[first()]/port", []any{8080}},
+		{"/services/*[port>100][last()]/port", []any{6379}},
+		{"/services/*/tags[#0]", []any{"z", "x"}},
+		{"/services/*/tags[#0][last()]", []any{"x"}},
+		{"/services/**[last()]", []any{"y"}},
+		{"/services[#0]", []any{}},
+		{"/services[first()]/web/port", []any{80}},
+		{"/items/*[first(2)]", []any{"a", "b"}},
+		{"/items/*[last(3)]", []any{"b", "c", "d"}},
+		{"/items/*[first(3)][last(2)]", []any{"b", "c"}},
+		{"/items/*[first(9)]", []any{"a", "b", "c", "d"}},
+		{"/items/*[last( 0 )]", []any{}},
+		{"/services/*[last(2)]/port", []any{6379, 80}},
+	}
+	for _, tt := range tests {
+		got := []any{}
+		for _, n := range tree.Root().Get(tt.path) {
+			got = append(got, n.Value())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s = %v, want %v", tt.path, got, tt.want)
+		}
+	}
+
+	for _, path := range []string{"a[#]", "a[#x]", "a[#1:x]", "a[#1,b]", "a[first(),b]", "a[first(-1)]", "a[last(x)]", "a[first(1]"} {
+		if _, err := CompilePath(path); err == nil {
+			t.Errorf("CompilePath(%q) should fail", path)
+		}
+	}
+}
+
+func TestPathFunctions(t *testing.T) {
+	tree := New()
+	tree.AddType(func(n Node) Object { return &testObject{node: n, events: &[]string{}} }, "Test")
+	tree.Set(map[string]any{
+		"services": map[string]any{
+			"web": map[string]any{
+				"object":    "Test",
+				"endpoints": map[string]any{"a": 1, "b": 2, "c": 3},
+				"prices":    []any{10, 20},
+			},
+			"api": map[string]any{
+				"endpoints": map[string]any{"a": 1},
+				"prices":    []any{5, 50},
+				"admin":     true,
+				"port":      8080,
+			},
+		},
+	})
+
+	tests := []struct {
+		filter string
+		want   []string
+	}{
+		{"[count(endpoints/*)>2]", []string{"web"}},
+		{"[count()=4]", []string{"api"}},
+		{"[count(missing/*)=0]", []string{"api", "web"}},
+		{"[keys()=admin]", []string{"api"}},
+		{"[keys(endpoints) in (b, c)]", []string{"web"}},
+		{"[keys(endpoints)!=b]", []string{"api"}},
+		{"[sum(prices)=55]", []string{"api"}},
+		{"[sum(endpoints/*)>=6]", []string{"web"}},
+		{"[min(prices)<10,max(prices)>20]", []string{"api"}},
+		{"[type()=Test]", []string{"web"}},
+		{"[!type()]", []string{"api"}},
+		{"[exists(endpoints/b)]", []string{"web"}},
+		{"[!exists(admin)|count(endpoints/*)>2]", []string{"web"}},
+	}
+	for _, tt := range tests {
+		got := []string{}
+		for _, n := range tree.Root().Get("/services/*" + tt.filter) {
+			got = append(got, n.Name())
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s matched %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+
+	if _, err := CompilePath("*[double(port)>100]"); err == nil {
+		t.Errorf("unknown function should fail to compile")
+	}
+	if n := len(tree.Root().Get("/services/*[double(count(endpoints/*))>4]")); n != 0 {
+		t.Errorf("unknown function matched %d nodes", n)
+	}
+	defer func() {
+		pathFunctions.Lock()
+		delete(pathFunctions.m, "double")
+		pathFunctions.Unlock()
+		clearPathCache()
+	}()
+	if err := RegisterPathFunction("double", func(n Node, args []string) any {
+		return float64(len(n.Get(args[0]))) * 2
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(tree.Root().Get("/services/*[double(endpoints/*)>4]")); n != 1 {
+		t.Errorf("registered function matched %d nodes, want 1", n)
+	}
+
+	// The function reads the nodes while the tree is locked for writing
+	matched := 0
+	unsubscribe := tree.Subscribe("/services/*[double(endpoints/*)>4]", func(e ChangeEvent) {
+		matched++
+	})
+	defer unsubscribe()
+	tree.Set(map[string]any{"services": map[string]any{"web": map[string]any{"endpoints": map[string]any{"d": 4}}}})
+	if matched != 1 {
+		t.Errorf("subscription matched %d changes, want 1", matched)
+	}
+	if err := RegisterPathFunction("bad-name", nil); err == nil {
+		t.Errorf("invalid function name should be rejected")
+	}
+	for _, name := range []string{"first", "last"} {
+		if err := RegisterPathFunction(name, func(n Node, args []string) any { return true }); err == nil {
+			t.Errorf("reserved function name %s should be rejected", name)
+		}
+	}
+
+	for path, pos := range map[string]int{
+		"*[count(a]": 7, "*[a/b(c)=1]": 2, "*[nope()]": 2, "*[count(a[)=0]": 9, "*[sum(a, b/[x)>1]": 11,
+	} {
+		var syntaxErr *PathSyntaxError
+		if _, err := CompilePath(path); !errors.As(err, &syntaxErr) || syntaxErr.Pos != pos {
+			t.Errorf("CompilePath(%q) error = %v, want position %d", path, err, pos)
+		}
+	}
+}
+
+func TestPathCache(t *testing.T) {
+	clearPathCache()
+	defer clearPathCache()
+
+	var logged bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logged)
+
+	// Invalid paths are logged once, when they are compiled
+	tree := New()
+	for i := 0; i < 3; i++ {
+		if n := len(tree.Root().Get("a[b")); n != 0 {
+			t.Errorf("invalid path matched %d nodes", n)
+		}
+	}
+	if n := bytes.Count(logged.Bytes(), []byte("invalid path")); n != 1 {
+		t.Errorf("syntax error logged %d times, want 1: %s", n, logged.String())
+	}
+
+	// The recently used paths are kept when the cache is full
+	compilePathCached("a")
+	for i := 0; i < pathCacheSize; i++ {
+		compilePathCached("a")
+		compilePathCached(fmt.Sprintf("p%d", i))
+	}
+	pathCache.Lock()
+	_, keptA := pathCache.m["a"]
+	_, keptP0 := pathCache.m["p0"]
+	size := pathCache.order.Len()
+	pathCache.Unlock()
+	if !keptA || keptP0 || size != pathCacheSize {
+		t.Errorf("cache keeps a: %v, p0: %v, size %d", keptA, keptP0, size)
+	}
+}
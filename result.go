@@ -0,0 +1,150 @@
+package forjitree
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ObjectInfo identifies an object (or an object type reference) in the tree
+type ObjectInfo struct {
+	Path string
+	Type string
+}
+
+// SetResult reports the effects of a single Tree.Set call including the outputs published by objects after it.
+// The Set calls made by the objects in their callbacks have their own results.
+type SetResult struct {
+	Modified     []string
+	Created      []ObjectInfo
+	Destroyed    []ObjectInfo
+	Updated      []ObjectInfo
+	UnknownTypes []ObjectInfo
+	Errors       []error
+
+	createdNodes map[*node]bool
+	updatedNodes map[*node]bool
+}
+
+// ObjectError is an error which happened with the object at the path
+type ObjectError struct {
+	Path string
+	Type string
+	Err  error
+}
+
+func (e *ObjectError) Error() string {
+	path := e.Path
+	if path == "" {
+		path = "/"
+	}
+	if e.Type == "" {
+		return fmt.Sprintf("%s: %v", path, e.Err)
+	}
+	return fmt.Sprintf("%s (%s): %v", path, e.Type, e.Err)
+}
+
+func (e *ObjectError) Unwrap() error {
+	return e.Err
+}
+
+// PanicError is a panic recovered from an object lifecycle callback
+type PanicError struct {
+	Callback string
+	Value    any
+	Stack    []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic in %s: %v", e.Callback, e.Value)
+}
+
+var ErrReadOnly = errors.New("tree is read-only")
+
+func newSetResult() *SetResult {
+	return &SetResult{
+		Modified:     []string{},
+		Created:      []ObjectInfo{},
+		Destroyed:    []ObjectInfo{},
+		Updated:      []ObjectInfo{},
+		UnknownTypes: []ObjectInfo{},
+		Errors:       []error{},
+		createdNodes: map[*node]bool{},
+		updatedNodes: map[*node]bool{},
+	}
+}
+
+// Err joins all errors of the result, nil if there were none
+func (r *SetResult) Err() error {
+	if r == nil {
+		return nil
+	}
+	return errors.Join(r.Errors...)
+}
+
+func (r *SetResult) objectCreated(n *node) {
+	if r == nil {
+		return
+	}
+	r.createdNodes[n] = true
+	r.Created = append(r.Created, ObjectInfo{Path: n.path(), Type: n.objType.Name})
+}
+
+func (r *SetResult) objectDestroyed(n *node) {
+	if r == nil {
+		return
+	}
+	r.Destroyed = append(r.Destroyed, ObjectInfo{Path: n.path(), Type: n.objType.Name})
+}
+
+func (r *SetResult) objectUpdated(n *node) {
+	if r == nil || r.createdNodes[n] || r.updatedNodes[n] {
+		return
+	}
+	r.updatedNodes[n] = true
+	r.Updated = append(r.Updated, ObjectInfo{Path: n.path(), Type: n.objType.Name})
+}
+
+func (r *SetResult) unknownType(n *node, typeName string) {
+	if r == nil {
+		return
+	}
+	r.UnknownTypes = append(r.UnknownTypes, ObjectInfo{Path: n.path(), Type: typeName})
+}
+
+func (r *SetResult) addError(n *node, err error) {
+	r.addObjectError(newObjectError(n, err))
+}
+
+func (r *SetResult) addObjectError(err *ObjectError) {
+	if r == nil {
+		return
+	}
+	r.Errors = append(r.Errors, err)
+}
+
+func newObjectError(n *node, err error) *ObjectError {
+	objErr := &ObjectError{Path: n.path(), Err: err}
+	if n.objType != nil {
+		objErr.Type = n.objType.Name
+	}
+	return objErr
+}
+
+// merge adds the result of a nested Set
+func (r *SetResult) merge(r2 *SetResult) {
+	if r == nil || r2 == nil {
+		return
+	}
+	r.Modified = append(r.Modified, r2.Modified...)
+	r.Created = append(r.Created, r2.Created...)
+	r.Destroyed = append(r.Destroyed, r2.Destroyed...)
+	r.Updated = append(r.Updated, r2.Updated...)
+	r.UnknownTypes = append(r.UnknownTypes, r2.UnknownTypes...)
+	r.Errors = append(r.Errors, r2.Errors...)
+	for n := range r2.createdNodes {
+		r.createdNodes[n] = true
+	}
+	for n := range r2.updatedNodes {
+		r.updatedNodes[n] = true
+	}
+}
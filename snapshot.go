@@ -0,0 +1,236 @@
+package forjitree
+
+import (
+	"runtime"
+	"strconv"
+	"sync"
+)
+
+// Snapshot is a read-only view of the tree at some version. Taking a snapshot copies nothing: the tree saves
+// the previous state of every node before changing it while the snapshot is alive (copy-on-write).
+// The nodes of the snapshot support the same Get and Query API as the nodes of the tree, they are built on the
+// first read and objects are not created for them. Set, CleanNulls and Publish of the snapshot nodes panic with ErrReadOnly.
+type Snapshot struct {
+	version uint64
+	state   *snapshotState
+
+	once sync.Once
+	view *Tree
+}
+
+// snapshotState is referenced by the tree while the Snapshot is reachable
+type snapshotState struct {
+	tree  *Tree
+	root  *node
+	saved map[*node]*nodeState
+}
+
+func (t *Tree) Snapshot() *Snapshot {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	state := &snapshotState{
+		tree:  t,
+		root:  t.rootNode,
+		saved: map[*node]*nodeState{},
+	}
+	t.snapshotsMutex.Lock()
+	t.snapshots[state] = true
+	t.snapshotsMutex.Unlock()
+
+	s := &Snapshot{
+		version: t.version,
+		state:   state,
+	}
+	runtime.SetFinalizer(s, func(s *Snapshot) {
+		t.snapshotsMutex.Lock()
+		delete(t.snapshots, s.state)
+		t.snapshotsMutex.Unlock()
+	})
+	return s
+}
+
+// save remembers the state of the node before it is modified for the snapshots
+func (t *Tree) save(n *node) {
+	t.snapshotsMutex.Lock()
+	for s := range t.snapshots {
+		if _, ok := s.saved[n]; !ok {
+			s.saved[n] = saveNodeState(n)
+		}
+	}
+	t.snapshotsMutex.Unlock()
+}
+
+type nodeState struct {
+	parentKey string
+	value     any
+	m         map[string]*node
+	sl        []*node
+	nodeType  int
+}
+
+func saveNodeState(n *node) *nodeState {
+	state := &nodeState{
+		parentKey: n.parentKey,
+		value:     n.value,
+		nodeType:  n.nodeType,
+	}
+	if n.m != nil {
+		state.m = make(map[string]*node, len(n.m))
+		for k, v := range n.m {
+			state.m[k] = v
+		}
+	}
+	if n.sl != nil {
+		state.sl = make([]*node, len(n.sl))
+		copy(state.sl, n.sl)
+	}
+	return state
+}
+
+// nodeState returns the state of the node at the moment of the snapshot, the tree must be locked
+func (s *snapshotState) nodeState(n *node) *nodeState {
+	if state, ok := s.saved[n]; ok {
+		return state
+	}
+	return &nodeState{parentKey: n.parentKey, value: n.value, m: n.m, sl: n.sl, nodeType: n.nodeType}
+}
+
+func (s *snapshotState) value(n *node) any {
+	state := s.nodeState(n)
+	switch state.nodeType {
+	case NodeTypeMap:
+		m := make(map[string]any, len(state.m))
+		for k, v := range state.m {
+			m[k] = s.value(v)
+		}
+		return m
+	case NodeTypeSlice:
+		sl := make([]any, len(state.sl))
+		for i, v := range state.sl {
+			sl[i] = s.value(v)
+		}
+		return sl
+	}
+	return CloneValue(state.value)
+}
+
+// copyNode makes a node of the read-only tree with the snapshot state of the node
+func (s *snapshotState) copyNode(t *Tree, parent *node, parentKey string, src *node) *node {
+	state := s.nodeState(src)
+	n := newNode(t, parent, parentKey)
+	n.nodeType = state.nodeType
+	switch state.nodeType {
+	case NodeTypeMap:
+		n.m = make(map[string]*node, len(state.m))
+		for k, v := range state.m {
+			n.m[k] = s.copyNode(t, n, k, v)
+		}
+	case NodeTypeSlice:
+		n.sl = make([]*node, len(state.sl))
+		for i, v := range state.sl {
+			n.sl[i] = s.copyNode(t, n, strconv.Itoa(i), v)
+		}
+	default:
+		n.value = CloneValue(state.value)
+	}
+	return n
+}
+
+// revertPatch makes a patch which turns the live node into the node at the same position in the snapshot.
+// The nodes which are not saved have not changed since the snapshot.
+func (s *snapshotState) revertPatch(old *node, live *node) (any, bool) {
+	if old == live {
+		if _, saved := s.saved[live]; !saved {
+			return nil, false
+		}
+
+		state := s.nodeState(old)
+		if state.nodeType == NodeTypeMap && live.nodeType == NodeTypeMap {
+			patch := map[string]any{}
+			for k, v := range state.m {
+				if lv, ok := live.m[k]; ok {
+					if p, changed := s.revertPatch(v, lv); changed {
+						patch[k] = p
+					}
+				} else {
+					patch[k] = s.value(v)
+				}
+			}
+			for k := range live.m {
+				if _, ok := state.m[k]; !ok {
+					patch[k] = Delete
+				}
+			}
+			return patch, len(patch) > 0
+		}
+	}
+
+	return diffPatch(live.getValue(), s.value(old))
+}
+
+// readOnlyTree builds the nodes of the snapshot once
+func (s *Snapshot) readOnlyTree() *Tree {
+	s.once.Do(func() {
+		t := s.state.tree
+		t.lock.RLock()
+		defer t.lock.RUnlock()
+
+		s.view = newTree()
+		s.view.name = t.name
+		s.view.rootNode = s.state.copyNode(s.view, nil, "", s.state.root)
+		s.view.created = true
+		s.view.readOnly = true
+	})
+	return s.view
+}
+
+func (s *Snapshot) Version() uint64 {
+	return s.version
+}
+
+func (s *Snapshot) Root() Node {
+	return s.readOnlyTree().rootNode
+}
+
+func (s *Snapshot) Get(path string) []Node {
+	return s.readOnlyTree().rootNode.Get(path)
+}
+
+func (s *Snapshot) GetOne(path string) Node {
+	return s.readOnlyTree().rootNode.GetOne(path)
+}
+
+func (s *Snapshot) Query(q any) (any, error) {
+	return s.readOnlyTree().rootNode.Query(q)
+}
+
+func (s *Snapshot) Value() any {
+	return s.readOnlyTree().GetValue()
+}
+
+// Revert applies the changes needed to bring the tree back to the snapshot state.
+// Only the nodes changed since the snapshot are compared if the snapshot is taken from this tree.
+// Objects are created, updated and destroyed as with Set. The tree is not modified if any object fails.
+func (t *Tree) Revert(s *Snapshot) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var patch any
+	var changed bool
+	if s.state.tree == t {
+		patch, changed = s.state.revertPatch(s.state.root, t.rootNode)
+	} else {
+		var value any
+		t.unlocked(func() {
+			value = s.Value()
+		})
+		patch, changed = diffPatch(t.rootNode.getValue(), value)
+	}
+	if !changed {
+		return nil
+	}
+	return t.atomically(func() error {
+		return t.set(patch).Err()
+	})
+}
@@ -0,0 +1,134 @@
+package forjitree
+
+import (
+	"sort"
+	"strings"
+)
+
+// ChangeEvent is passed to the subscribers after each Set which changes the tree
+type ChangeEvent = Change
+
+type subscription struct {
+	id      int
+	pattern string
+	fn      func(ChangeEvent)
+}
+
+type subscriptionEvent struct {
+	s *subscription
+	e ChangeEvent
+}
+
+// Subscribe calls fn for every change of the nodes matching the path pattern, their subnodes or parents.
+// The pattern is evaluated from the root both before and after the change, so removed nodes are matched too.
+// Links and redirects are not followed. fn is called with the tree unlocked. Returns a function which cancels the subscription.
+func (t *Tree) Subscribe(pathPattern string, fn func(ChangeEvent)) (unsubscribe func()) {
+	t.subscriptionsMutex.Lock()
+	defer t.subscriptionsMutex.Unlock()
+
+	t.subscriptionsCounter++
+	s := &subscription{
+		id:      t.subscriptionsCounter,
+		pattern: pathPattern,
+		fn:      fn,
+	}
+	t.subscriptions[s.id] = s
+
+	return func() {
+		t.subscriptionsMutex.Lock()
+		delete(t.subscriptions, s.id)
+		t.subscriptionsMutex.Unlock()
+	}
+}
+
+func (t *Tree) getSubscriptions() []*subscription {
+	t.subscriptionsMutex.Lock()
+	defer t.subscriptionsMutex.Unlock()
+
+	result := make([]*subscription, 0, len(t.subscriptions))
+	for _, s := range t.subscriptions {
+		result = append(result, s)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].id < result[j].id
+	})
+	return result
+}
+
+// matchSubscriptions returns paths of the nodes matching each subscription pattern
+func (t *Tree) matchSubscriptions(subscriptions []*subscription, matched map[*subscription][]string) map[*subscription][]string {
+	if matched == nil {
+		matched = map[*subscription][]string{}
+	}
+	for _, s := range subscriptions {
+		path := s.pattern
+		if !strings.HasPrefix(path, "/") {
+			path = "/" + path
+		}
+		for _, n := range t.rootNode.getEx(path, false, false, true) {
+			matched[s] = append(matched[s], n.path())
+		}
+	}
+	return matched
+}
+
+func (t *Tree) makeSubscriptionEvents(changes []Change, matched map[*subscription][]string) []subscriptionEvent {
+	events := []subscriptionEvent{}
+	for s, paths := range matched {
+		for _, c := range changes {
+			for _, p := range paths {
+				if isSubpath(c.Path, p) || isSubpath(p, c.Path) {
+					events = append(events, subscriptionEvent{s: s, e: c})
+					break
+				}
+			}
+		}
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].s.id < events[j].s.id
+	})
+	return events
+}
+
+func (t *Tree) notifySubscribers(events []subscriptionEvent) {
+	for _, e := range events {
+		// Skip the subscriptions cancelled by the previous callbacks
+		t.subscriptionsMutex.Lock()
+		_, active := t.subscriptions[e.s.id]
+		t.subscriptionsMutex.Unlock()
+		if active {
+			t.unlocked(func() {
+				e.s.fn(e.e)
+			})
+		}
+	}
+}
+
+// isSubpath checks whether the path is equal to the parent path or lies under it
+func isSubpath(path string, parent string) bool {
+	return parent == "" || path == parent || strings.HasPrefix(path, parent+"/")
+}
+
+// listChanges lists the changes made to the captured nodes
+func (n *node) listChanges(c *inverseCapture, path string, changes *[]Change) {
+	if !c.exists {
+		if n != nil {
+			*changes = append(*changes, Change{Path: path, Kind: ChangeAdded, NewValue: n.getValue()})
+		}
+		return
+	}
+
+	if n == nil {
+		*changes = append(*changes, Change{Path: path, Kind: ChangeRemoved, OldValue: c.value})
+		return
+	}
+
+	if c.children != nil {
+		for k, cc := range c.children {
+			n.getChild(k).listChanges(cc, path+"/"+k, changes)
+		}
+		return
+	}
+
+	diff(c.value, n.getValue(), path, changes)
+}
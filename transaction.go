@@ -0,0 +1,153 @@
+package forjitree
+
+import (
+	"errors"
+	"fmt"
+)
+
+// transaction collects the inverse patches of the applied changes to roll them back.
+// The history records, the subscription events and the version increment are delayed until commit.
+type transaction struct {
+	inverses []any
+	records  []historyRecord
+	changed  bool
+	events   []subscriptionEvent
+	history  *historyMark
+}
+
+// historyRecord holds the patches of a Set and their inverse patches
+type historyRecord struct {
+	patches  []any
+	inverses []any
+}
+
+// Begin starts a transaction. All following Set calls can be reverted with Rollback until Commit is called.
+// The transaction belongs to the tree, not to the goroutine: the Set calls made by other goroutines and by the objects
+// before Commit or Rollback become a part of it. Subscribers receive the changes of the transaction only after Commit.
+func (t *Tree) Begin() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.begin()
+}
+
+func (t *Tree) begin() error {
+	if t.tx != nil {
+		return errors.New("transaction is already in progress")
+	}
+	t.tx = &transaction{history: t.history.mark()}
+	return nil
+}
+
+func (t *Tree) Commit() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.commit()
+}
+
+func (t *Tree) commit() error {
+	tx := t.tx
+	if tx == nil {
+		return errors.New("no transaction in progress")
+	}
+	t.tx = nil
+	t.commitTx(tx)
+	return nil
+}
+
+func (t *Tree) commitTx(tx *transaction) {
+	if tx.changed {
+		t.modified = true
+		t.version++
+	}
+	if t.history != nil {
+		for _, r := range tx.records {
+			t.history.record(r.patches, r.inverses)
+		}
+	}
+	t.notifySubscribers(tx.events)
+}
+
+// Rollback applies the inverse patches of the transaction in reverse order: the objects created during
+// the transaction are destroyed and the destroyed ones are created again. Subscribers are not notified.
+func (t *Tree) Rollback() error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.rollback()
+}
+
+func (t *Tree) rollback() error {
+	tx := t.tx
+	if tx == nil {
+		return errors.New("no transaction in progress")
+	}
+	t.tx = nil
+	t.rollbackTx(tx)
+	t.history.restore(tx.history)
+	return nil
+}
+
+func (t *Tree) rollbackTx(tx *transaction) {
+	if len(tx.inverses) == 0 {
+		return
+	}
+	patches := make([]any, len(tx.inverses))
+	for i, inverse := range tx.inverses {
+		patches[len(patches)-1-i] = inverse
+	}
+
+	// The inverse patches are applied in a transaction which is dropped, so the version, the history
+	// and the subscribers don't see them
+	state := t.state
+	t.state = setState{tx: &transaction{}}
+	defer func() {
+		t.state = state
+	}()
+	t.setPatches(patches)
+}
+
+// SetTx applies the patch atomically. If any object fails during the update, the tree is rolled back
+// to the previous state and the error is returned. If a transaction is already in progress, the patch becomes a part of it.
+func (t *Tree) SetTx(data any) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.atomically(func() error {
+		return t.set(data).Err()
+	})
+}
+
+// atomically runs f in a transaction which is rolled back if f panics or returns an error. Unlike Begin,
+// the transaction includes only the changes made by f. If a transaction is already in progress, f is called directly.
+// The tree should be locked for writing.
+func (t *Tree) atomically(f func() error) (err error) {
+	if t.transaction() != nil {
+		return f()
+	}
+	tx := &transaction{}
+	t.state.tx = tx
+
+	defer func() {
+		t.state.tx = nil
+		if r := recover(); r != nil {
+			err = fmt.Errorf("transaction rolled back: %v", r)
+		}
+		if err != nil {
+			t.rollbackTx(tx)
+			return
+		}
+		t.commitTx(tx)
+	}()
+
+	return f()
+}
+
+// transaction returns the transaction which the Set in progress belongs to
+func (t *Tree) transaction() *transaction {
+	if t.state.tx != nil {
+		return t.state.tx
+	}
+	return t.tx
+}
@@ -1,11 +1,19 @@
 package forjitree
 
 import (
+	"context"
+	"fmt"
+	"sort"
 	"sync"
 	"time"
 )
 
+// Tree is safe for concurrent use. All reads (Get, Query, GetValue, Watch, ...) and writes (Set, Clear, AddType, ...)
+// are serialized with a tree-wide single-writer/multi-reader lock, see treeLock. The object callbacks are called
+// with the lock released, so they can use the tree.
 type Tree struct {
+	lock treeLock
+
 	objectTypes map[string]*ObjectType
 	rootNode    *node
 	created     bool
@@ -13,18 +21,80 @@ type Tree struct {
 	name        string
 	datasource  Datasource
 
+	// Nodes which reference the types which are not registered yet
+	unknownTypeNodes map[string]map[*node]bool
+
+	// Set during patching, the objects of the removed nodes are destroyed later by synchronizeNodes
+	deferDestroy   bool
+	pendingDestroy []*node
+
+	// Set by Start until Shutdown, ctx is passed to the objects started later
+	started  bool
+	startCtx context.Context
+
+	// Transaction started by Begin, it includes the Set calls of all goroutines
+	tx *transaction
+
+	// Incremented on every change of the tree, a transaction increments it once on commit
+	version  uint64
+	readOnly bool
+
+	// Live snapshots, the nodes save their state to them before they are modified
+	snapshots      map[*snapshotState]bool
+	snapshotsMutex sync.Mutex
+
+	history *history
+
+	state setState
+
+	errorHandler ErrorHandler
+
+	subscriptions        map[int]*subscription
+	subscriptionsCounter int
+	subscriptionsMutex   sync.Mutex
+
 	watchers               map[string]*watcher
 	watchersMutex          sync.Mutex
 	watchersCleanTimestamp time.Time
 	watchersCleanInterval  float64
 }
 
+// setState belongs to the Set in progress. Tree.unlocked swaps it out while the callbacks run,
+// so the Set calls made meanwhile by the callbacks and by other goroutines don't share it.
+type setState struct {
+	result *SetResult
+
+	// Transaction of SetTx and the other atomic changes
+	tx *transaction
+
+	// Set by Undo and Redo to skip recording of their own patches
+	applyingHistory bool
+
+	// Node which object publishes the values, it doesn't receive Updated for them
+	publishing *node
+}
+
+// ErrorHandler receives the failures of objects as *ObjectError: the panics recovered from the object callbacks
+// wrapped as *PanicError, the errors returned by Start and Stop and the registration errors of the type objects.
+// It is called with the tree unlocked like the callbacks.
+type ErrorHandler func(err *ObjectError)
+
 func New() *Tree {
+	t := newTree()
+	t.objectTypes[TypeKeyword] = NewObjectType(NewTypeObject, TypeKeyword)
+	return t
+}
+
+// newTree makes a tree without the built-in types
+func newTree() *Tree {
 	t := &Tree{
 		objectTypes:            make(map[string]*ObjectType),
+		unknownTypeNodes:       make(map[string]map[*node]bool),
 		created:                false,
 		modified:               false,
 		watchers:               make(map[string]*watcher),
+		subscriptions:          make(map[int]*subscription),
+		snapshots:              make(map[*snapshotState]bool),
 		watchersCleanTimestamp: time.Now(),
 		watchersCleanInterval:  60,
 	}
@@ -33,115 +103,456 @@ func New() *Tree {
 }
 
 func (t *Tree) Created() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.createTree()
+}
+
+// createTree calls CreatedTree of all objects once
+func (t *Tree) createTree() {
 	if t.created {
 		return
 	}
 	t.rootNode.callCreatedTree()
 	t.created = true
+
+	for _, n := range append([]*node{t.rootNode}, t.rootNode.getChildren(true)...) {
+		n.publishOutputs()
+	}
 }
 
 func (t *Tree) Clear() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.watchersMutex.Lock()
 	t.watchers = make(map[string]*watcher)
-	t.rootNode.destroyObject(true)
+	t.watchersMutex.Unlock()
+
+	// The root is replaced before the callbacks, so the Set calls made meanwhile don't add objects to the old one
+	root := t.rootNode
 	t.rootNode = newNode(t, nil, "")
+	t.unknownTypeNodes = make(map[string]map[*node]bool)
 	t.created = false
 	t.modified = true
+	t.version++
+
+	// The created objects are destroyed in the order of dependencies, the rest are discarded
+	created := []*node{}
+	for _, n := range append([]*node{root}, root.getChildren(true)...) {
+		if n.objCreated {
+			created = append(created, n)
+		}
+	}
+	t.destroyObjects(created)
+	root.destroyObject(true)
 }
 
 func (t *Tree) GetValue() any {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
 	return t.rootNode.getValue()
 }
 
-func (t *Tree) Set(data any) {
-	modifiedNodes := t.rootNode.patch(data)
+func (t *Tree) Set(data any) *SetResult {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.set(data)
+}
+
+func (t *Tree) set(data any) *SetResult {
+	return t.setPatches([]any{data})
+}
+
+// setPatches applies the patches one by one as sequential Set calls do and synchronizes the objects once
+func (t *Tree) setPatches(patches []any) *SetResult {
+	result := newSetResult()
+	if t.readOnly {
+		result.Errors = append(result.Errors, ErrReadOnly)
+		return result
+	}
+
+	// Results of the outputs published after the change are merged into the outer result
+	outerResult := t.state.result
+	t.state.result = result
+	defer func() {
+		t.state.result = outerResult
+		outerResult.merge(result)
+	}()
+
+	// Path functions of the patterns may release the lock, so the nodes are matched before the values are captured
+	subscriptions := t.getSubscriptions()
+	var matched map[*subscription][]string
+	if len(subscriptions) > 0 {
+		matched = t.matchSubscriptions(subscriptions, nil)
+	}
+
+	// Remember the values which are going to be changed to make the inverse patches and the change events
+	var capture *inverseCapture
+	tx := t.transaction()
+	recordHistory := t.history != nil && !t.state.applyingHistory
+	captureChanges := tx != nil || recordHistory || len(subscriptions) > 0 || t.hasWatchers()
+	var recorded, inverses []any
+	var modifiedNodes []*node
+	for _, data := range patches {
+		var c *inverseCapture
+		if captureChanges {
+			c = t.rootNode.captureInverse(data)
+			capture = mergeCapture(capture, c)
+		}
+
+		modified := t.patch(data)
+		if len(modified) == 0 {
+			continue
+		}
+		modifiedNodes = append(modifiedNodes, modified...)
+		if tx != nil || recordHistory {
+			if inverse, changed := t.rootNode.makeInverse(c); changed {
+				recorded = append(recorded, data)
+				inverses = append(inverses, inverse)
+			}
+		}
+	}
+	if len(patches) > 1 {
+		modifiedNodes = uniqueModifiedNodes(modifiedNodes)
+	}
+	if capture != nil {
+		t.collectChanges(capture)
+	}
+
+	t.synchronizeNodes(modifiedNodes)
+
+	for i := len(modifiedNodes) - 1; i >= 0; i-- {
+		result.Modified = append(result.Modified, modifiedNodes[i].path())
+	}
+
+	var events []subscriptionEvent
+	if len(modifiedNodes) > 0 {
+		if tx != nil {
+			tx.changed = true
+			tx.inverses = append(tx.inverses, inverses...)
+		} else {
+			t.modified = true
+			t.version++
+		}
+
+		// The history of a transaction is recorded on commit
+		if recordHistory {
+			if tx != nil {
+				tx.records = append(tx.records, historyRecord{patches: recorded, inverses: inverses})
+			} else {
+				t.history.record(recorded, inverses)
+			}
+		}
+
+		if len(subscriptions) > 0 {
+			changes := []Change{}
+			t.rootNode.listChanges(capture, "", &changes)
+			sort.SliceStable(changes, func(i, j int) bool {
+				return changes[i].Path < changes[j].Path
+			})
+			events = t.makeSubscriptionEvents(changes, t.matchSubscriptions(subscriptions, matched))
+		}
+	}
+
+	// Changes of a transaction are passed to subscribers on commit
+	if tx != nil {
+		tx.events = append(tx.events, events...)
+	} else {
+		t.notifySubscribers(events)
+	}
+
+	// Objects may have changed their output fields in the callbacks, they are published once this change is applied
+	for i := len(modifiedNodes) - 1; i >= 0; i-- {
+		modifiedNodes[i].publishOutputs()
+	}
+	return result
+}
+
+// uniqueModifiedNodes drops the repeated nodes and the nodes removed by the later patches,
+// the children go before their parents as in the nodes modified by a single patch
+func uniqueModifiedNodes(nodes []*node) []*node {
+	unique := []*node{}
+	added := map[*node]bool{}
+	for _, n := range nodes {
+		if !added[n] && n.isAttached() {
+			added[n] = true
+			unique = append(unique, n)
+		}
+	}
+	sort.SliceStable(unique, func(i, j int) bool {
+		return unique[i].depth() > unique[j].depth()
+	})
+	return unique
+}
+
+// patch applies the data to the nodes, the objects of the removed nodes stay alive until synchronizeNodes
+func (t *Tree) patch(data any) []*node {
+	deferDestroy := t.deferDestroy
+	t.deferDestroy = true
+	defer func() {
+		t.deferDestroy = deferDestroy
+	}()
+	return t.rootNode.patch(data)
+}
+
+// synchronizeNodes creates, updates and destroys objects of the modified nodes.
+// The nodes are expected in the order returned by patch (children before parents).
+func (t *Tree) synchronizeNodes(modifiedNodes []*node) {
+	// Destroy objects of the removed nodes and the objects which type has changed, dependents first
+	destroyed := t.pendingDestroy
+	t.pendingDestroy = nil
+	for i := len(modifiedNodes) - 1; i >= 0; i-- {
+		if n := modifiedNodes[i]; n.objCreated {
+			if newType, _ := n.resolveType(); newType != n.objType {
+				destroyed = append(destroyed, n)
+			}
+		}
+	}
+	t.destroyObjects(destroyed)
 
 	// Call synchronize for modified nodes
-	createdObjects := []*node{}
+	preparedObjects := []*node{}
 	for i := len(modifiedNodes) - 1; i >= 0; i-- {
 		if modifiedNodes[i].synchronize() {
-			createdObjects = append(createdObjects, modifiedNodes[i])
+			preparedObjects = append(preparedObjects, modifiedNodes[i])
 		}
 	}
 
+	// Call Created in the order of dependencies
+	createdObjects := t.createObjects(preparedObjects)
+
 	// Call CreatedChildren
 	for i := len(createdObjects) - 1; i >= 0; i-- {
-		createdObjects[i].obj.CreatedChildren()
+		if n := createdObjects[i]; n.obj != nil {
+			n.callObject("CreatedChildren", n.obj.CreatedChildren)
+		}
 	}
 
 	// Call CreatedTree if the tree has already been created
 	if t.created {
 		for i := 0; i < len(createdObjects); i++ {
-			createdObjects[i].obj.CreatedTree()
+			if n := createdObjects[i]; n.obj != nil {
+				n.callObject("CreatedTree", n.obj.CreatedTree)
+			}
 		}
 	}
 
-	if len(modifiedNodes) > 0 {
-		t.modified = true
+	// Start the new objects if the tree has been started
+	if t.started {
+		for _, n := range createdObjects {
+			n.startObject()
+		}
 	}
+}
 
-	// Merge with watchers changes
+// collectChanges passes the values captured before a change to the watchers
+func (t *Tree) collectChanges(c *inverseCapture) {
 	t.watchersMutex.Lock()
 	for _, w := range t.watchers {
-		w.collectChanges(data)
+		w.collectChanges(c)
 	}
 	t.watchersMutex.Unlock()
 }
 
+func (t *Tree) hasWatchers() bool {
+	t.watchersMutex.Lock()
+	defer t.watchersMutex.Unlock()
+	return len(t.watchers) > 0
+}
+
 func (t *Tree) Watch(watcherId string) any {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	t.watchersMutex.Lock()
+
 	// Clean watchers routine - delete those ones which haven't been accessed for longer than watchersCleanInterval
 	if time.Since(t.watchersCleanTimestamp).Seconds() > t.watchersCleanInterval/2 {
 		t.watchersCleanTimestamp = time.Now()
-		t.watchersMutex.Lock()
 		for wid, w := range t.watchers {
-			if time.Since(w.extractTimestamp).Seconds() > t.watchersCleanInterval {
+			if time.Since(w.getExtractTimestamp()).Seconds() > t.watchersCleanInterval {
 				delete(t.watchers, wid)
 			}
 		}
-		t.watchersMutex.Unlock()
 	}
 
-	t.watchersMutex.Lock()
 	w, watcherExists := t.watchers[watcherId]
 
 	if watcherExists {
 		// Extract collected changes if watcher exists
 		t.watchersMutex.Unlock()
-		return w.extractChanges()
+		return w.extractChanges(t.rootNode)
 	} else {
 		// Otherwise return full value and create a new watcher
 		t.watchers[watcherId] = newWatcher(watcherId)
 		t.watchersMutex.Unlock()
-		return t.GetValue()
+		return t.rootNode.getValue()
 	}
 }
 
 func (t *Tree) AddTypes(typesStr string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
 	types, err := RegisteredTypes.GetTypesFromStr(typesStr)
 	if err != nil {
 		return err
 	}
-	for _, ot := range types {
-		t.objectTypes[ot.Name] = ot
-	}
+	t.addTypes(types)
 	return nil
 }
 
 func (t *Tree) AddType(newObjectFunc NewObjectFunc, name string) {
-	t.objectTypes[name] = NewObjectType(newObjectFunc, name)
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.setType(name, NewObjectType(newObjectFunc, name))
+}
+
+// AddObjectType adds the type made with NewObjectType or ObjectType.Derive
+func (t *Tree) AddObjectType(ot *ObjectType) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.setType(ot.Name, ot)
+}
+
+// AddDerivedType adds the type derived from the base one with the default data merged over the base type data
+func (t *Tree) AddDerivedType(base string, name string, defaultData map[string]any) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	baseType, ok := t.objectTypes[base]
+	if !ok {
+		return fmt.Errorf("base type %s is not found", base)
+	}
+	t.setType(name, baseType.Derive(name, defaultData))
+	return nil
 }
 
 func (t *Tree) AddPlugin(pluginFilename string) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
 	newTypes, err := NewObjectTypesFromPlugin(pluginFilename)
 	if err != nil {
 		return err
 	}
-	for _, ot := range newTypes {
-		t.objectTypes[ot.Name] = ot
-	}
+	t.addTypes(newTypes)
 	return nil
 }
 
+// RemoveType unregisters the type and destroys its objects. The nodes keep their data and get the objects back
+// if the type is added again.
+func (t *Tree) RemoveType(name string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.setType(name, nil)
+}
+
+// addTypes registers the types, the tree is synchronized once for all of them
+func (t *Tree) addTypes(types []*ObjectType) {
+	m := map[string]*ObjectType{}
+	for _, ot := range types {
+		m[ot.Name] = ot
+	}
+	t.setTypes(m)
+}
+
+// setType registers the type, nil removes it. The nodes which reference the type are synchronized:
+// the objects of the replaced type are recreated, the objects of the removed type are destroyed.
+func (t *Tree) setType(name string, ot *ObjectType) {
+	t.setTypes(map[string]*ObjectType{name: ot})
+}
+
+// setTypes is setType for several types at once
+func (t *Tree) setTypes(types map[string]*ObjectType) {
+	for name, ot := range types {
+		if ot == nil {
+			delete(t.objectTypes, name)
+		} else {
+			t.objectTypes[name] = ot
+		}
+	}
+	for _, n := range t.synchronizeTypes(types) {
+		n.publishOutputs()
+	}
+}
+
+// synchronizeTypes synchronizes the nodes which reference the types and returns them
+func (t *Tree) synchronizeTypes(types map[string]*ObjectType) []*node {
+	nodes := []*node{}
+	for name := range types {
+		for n := range t.unknownTypeNodes[name] {
+			if n.isAttached() && n.unknownType == name {
+				nodes = append(nodes, n)
+			}
+		}
+		delete(t.unknownTypeNodes, name)
+	}
+
+	// The existing objects of the types
+	for _, n := range append([]*node{t.rootNode}, t.rootNode.getChildren(true)...) {
+		if n.objType == nil {
+			continue
+		}
+		if _, ok := types[n.objType.Name]; ok {
+			nodes = append(nodes, n)
+		}
+	}
+
+	sort.SliceStable(nodes, func(i, j int) bool {
+		return nodes[i].depth() > nodes[j].depth()
+	})
+	t.synchronizeNodes(nodes)
+	return nodes
+}
+
+func (t *Tree) trackUnknownType(n *node, name string) {
+	if n.unknownType == name {
+		return
+	}
+	t.untrackUnknownType(n)
+	n.unknownType = name
+	if t.unknownTypeNodes[name] == nil {
+		t.unknownTypeNodes[name] = map[*node]bool{}
+	}
+	t.unknownTypeNodes[name][n] = true
+}
+
+func (t *Tree) untrackUnknownType(n *node) {
+	if n.unknownType == "" {
+		return
+	}
+	delete(t.unknownTypeNodes[n.unknownType], n)
+	if len(t.unknownTypeNodes[n.unknownType]) == 0 {
+		delete(t.unknownTypeNodes, n.unknownType)
+	}
+	n.unknownType = ""
+}
+
+// SetErrorHandler sets the handler of the object failures, nil disables it.
+// The failures are reported in SetResult.Errors regardless of the handler.
+func (t *Tree) SetErrorHandler(h ErrorHandler) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.errorHandler = h
+}
+
 func (t *Tree) GetType(name string) *ObjectType {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return t.getType(name)
+}
+
+func (t *Tree) getType(name string) *ObjectType {
 	if val, ok := t.objectTypes[name]; ok {
 		return val
 	}
@@ -149,29 +560,57 @@ func (t *Tree) GetType(name string) *ObjectType {
 }
 
 func (t *Tree) Root() *node {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
 	return t.rootNode
 }
 
+func (t *Tree) Version() uint64 {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
+	return t.version
+}
+
 func (t *Tree) IsModified() bool {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
 	return t.modified
 }
 
 func (t *Tree) ResetModified() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
 	t.modified = false
 }
 
 func (t *Tree) SetName(path string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
 	t.name = path
 }
 
 func (t *Tree) GetName() string {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
 	return t.name
 }
 
 func (t *Tree) SetDatasource(datasource Datasource) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
 	t.datasource = datasource
 }
 
 func (t *Tree) GetDatasource() Datasource {
+	t.lock.RLock()
+	defer t.lock.RUnlock()
+
 	return t.datasource
 }
@@ -0,0 +1,1560 @@
+package forjitree
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"slices"
+	"strconv"
+	"testing"
+	"time"
+)
+
+type testObject struct {
+	node   Node
+	events *[]string
+
+	Name  string
+	Value any
+}
+
+func (o *testObject) GetNode() Node { return o.node }
+func (o *testObject) Created() {
+	if o.Name == "panic" {
+		panic("bad object")
+	}
+	o.log("created")
+}
+func (o *testObject) CreatedChildren()                {}
+func (o *testObject) CreatedTree()                    {}
+func (o *testObject) Destroyed()                      { o.log("destroyed") }
+func (o *testObject) Updated(field string, value any) {}
+
+func (o *testObject) log(event string) {
+	*o.events = append(*o.events, event+" "+o.node.Path())
+}
+
+func newTestTree() (*Tree, *[]string) {
+	events := &[]string{}
+	t := New()
+	t.AddType(func(n Node) Object {
+		return &testObject{node: n, events: events}
+	}, "Test")
+	return t, events
+}
+
+func TestSetDelete(t *testing.T) {
+	tree, events := newTestTree()
+	tree.Set(map[string]any{
+		"a": map[string]any{"object": "Test", "name": "a"},
+		"b": map[string]any{"object": "Test", "value": 1},
+		"c": []any{1, 2, 3},
+	})
+	*events = nil
+
+	tree.Set(map[string]any{
+		"a": Delete,
+		"b": map[string]any{"value": map[string]any{DeleteKeyword: true}},
+		"c": map[string]any{"1": Delete},
+	})
+
+	want := map[string]any{
+		"b": map[string]any{"object": "Test"},
+		"c": []any{1, 3},
+	}
+	if got := tree.GetValue(); !reflect.DeepEqual(got, want) {
+		t.Errorf("GetValue() = %v, want %v", got, want)
+	}
+	if !reflect.DeepEqual(*events, []string{"destroyed /a"}) {
+		t.Errorf("events = %v", *events)
+	}
+	if obj := GetObj[*testObject](tree.Root().Get("b")); obj == nil || obj.Value != nil {
+		t.Errorf("field of the removed key is not reset: %v", obj)
+	}
+}
+
+func TestWatcherDelete(t *testing.T) {
+	tree, _ := newTestTree()
+	tree.Set(map[string]any{"a": 1, "b": 2})
+	tree.Watch("w")
+
+	tree.Set(map[string]any{"a": Delete})
+
+	want := map[string]any{"a": map[string]any{DeleteKeyword: true}}
+	if got := tree.Watch("w"); !reflect.DeepEqual(got, want) {
+		t.Errorf("Watch() = %v, want %v", got, want)
+	}
+}
+
+func TestSetEmptyMapOnSlice(t *testing.T) {
+	tree := New()
+	tree.Set(map[string]any{"c": []any{1, 2, 3}})
+
+	tree.Set(map[string]any{"c": map[string]any{}})
+
+	want := map[string]any{"c": map[string]any{}}
+	if got := tree.GetValue(); !reflect.DeepEqual(got, want) {
+		t.Errorf("GetValue() = %v, want %v", got, want)
+	}
+}
+
+func TestWatcherMergedChanges(t *testing.T) {
+	tree := New()
+	tree.Set(map[string]any{
+		"a": map[string]any{"x": 1, "y": 2},
+		"c": []any{1, 2, 3, 4},
+	})
+	client := New()
+	client.Set(tree.Watch("w"))
+
+	tree.Set(map[string]any{"c": map[string]any{"1": Delete}})
+	tree.Set(map[string]any{"c": map[string]any{"1": Delete}})
+	tree.Set(map[string]any{"a": Delete})
+	tree.Set(map[string]any{"a": map[string]any{"z": 3}})
+
+	client.Set(tree.Watch("w"))
+	if got, want := client.GetValue(), tree.GetValue(); !reflect.DeepEqual(got, want) {
+		t.Errorf("watched value = %v, want %v", got, want)
+	}
+	if got := tree.Watch("w"); got != nil {
+		t.Errorf("Watch() = %v, want no changes", got)
+	}
+}
+
+func TestCleanNulls(t *testing.T) {
+	tree, events := newTestTree()
+	tree.Set(map[string]any{
+		"a": map[string]any{"object": "Test", "name": nil},
+		"b": nil,
+	})
+
+	tree.Root().CleanNulls(true)
+
+	want := map[string]any{"a": map[string]any{"object": "Test"}}
+	if got := tree.GetValue(); !reflect.DeepEqual(got, want) {
+		t.Errorf("GetValue() = %v, want %v", got, want)
+	}
+	if !reflect.DeepEqual(*events, []string{"created /a"}) {
+		t.Errorf("events = %v", *events)
+	}
+}
+
+func TestSetTxRollback(t *testing.T) {
+	tree, events := newTestTree()
+	tree.Set(map[string]any{
+		"a": map[string]any{"object": "Test", "name": "a"},
+		"b": map[string]any{"object": "Test", "name": "b"},
+	})
+	before := tree.GetValue()
+	tree.Watch("w")
+	*events = nil
+
+	err := tree.SetTx(map[string]any{
+		"a": Delete,
+		"b": map[string]any{"name": "b2", "value": 1},
+		"c": map[string]any{"object": "Test", "name": "c"},
+		"d": map[string]any{"object": "Test", "name": "panic"},
+	})
+	if err == nil {
+		t.Fatal("SetTx() error expected")
+	}
+
+	if got := tree.GetValue(); !reflect.DeepEqual(got, before) {
+		t.Errorf("GetValue() = %v, want %v", got, before)
+	}
+	if obj := GetObj[*testObject](tree.Root().Get("a")); obj == nil {
+		t.Error("destroyed object is not recreated")
+	}
+	if obj := GetObj[*testObject](tree.Root().Get("b")); obj == nil || obj.Name != "b" || obj.Value != nil {
+		t.Errorf("object fields are not restored: %v", obj)
+	}
+	if got := tree.Watch("w"); got != nil {
+		t.Errorf("Watch() = %v, want no changes", got)
+	}
+
+	if err := tree.SetTx(map[string]any{"c": map[string]any{"object": "Test"}}); err != nil {
+		t.Fatalf("SetTx() error = %v", err)
+	}
+	if got := tree.Watch("w"); !reflect.DeepEqual(got, map[string]any{"c": map[string]any{"object": "Test"}}) {
+		t.Errorf("Watch() = %v", got)
+	}
+}
+
+func TestApplyJSONPatch(t *testing.T) {
+	tree, events := newTestTree()
+	tree.Set(map[string]any{
+		"a":     map[string]any{"object": "Test", "name": "a"},
+		"items": []any{1, 2, 3},
+		"conf":  map[string]any{"x": 1, "y": 2},
+	})
+	*events = nil
+
+	err := tree.ApplyJSONPatch([]JSONPatchOperation{
+		{Op: "test", Path: "/a/name", Value: "a"},
+		{Op: "add", Path: "/items/1", Value: 10},
+		{Op: "add", Path: "/items/-", Value: 20},
+		{Op: "remove", Path: "/items/0"},
+		{Op: "replace", Path: "/conf", Value: map[string]any{"z": 3}},
+		{Op: "copy", From: "/a", Path: "/b"},
+		{Op: "move", From: "/conf/z", Path: "/conf/w"},
+		{Op: "test", Path: "/items/0", Value: 10.0},
+	})
+	if err != nil {
+		t.Fatalf("ApplyJSONPatch() error = %v", err)
+	}
+
+	want := map[string]any{
+		"a":     map[string]any{"object": "Test", "name": "a"},
+		"b":     map[string]any{"object": "Test", "name": "a"},
+		"items": []any{10, 2, 3, 20},
+		"conf":  map[string]any{"w": 3},
+	}
+	if got := tree.GetValue(); !reflect.DeepEqual(got, want) {
+		t.Errorf("GetValue() = %v, want %v", got, want)
+	}
+	if !reflect.DeepEqual(*events, []string{"created /b"}) {
+		t.Errorf("events = %v", *events)
+	}
+
+	err = tree.ApplyJSONPatch([]JSONPatchOperation{
+		{Op: "remove", Path: "/b"},
+		{Op: "test", Path: "/a/name", Value: "b"},
+	})
+	if !errors.Is(err, ErrJSONPatchTestFailed) {
+		t.Errorf("ApplyJSONPatch() error = %v, want %v", err, ErrJSONPatchTestFailed)
+	}
+	if tree.Root().GetOne("b") == nil {
+		t.Error("failed patch should not modify the tree")
+	}
+
+	// Array items are removed, moved and inserted by index, the objects of the other items are kept
+	tree.Set(map[string]any{"list": []any{
+		map[string]any{"object": "Test", "name": "x"},
+		map[string]any{"object": "Test", "name": "y"},
+		map[string]any{"object": "Test", "name": "z"},
+	}})
+	y := GetObj[*testObject](tree.Root().Get("list/1"))
+	z := GetObj[*testObject](tree.Root().Get("list/2"))
+	*events = nil
+	err = tree.ApplyJSONPatch([]JSONPatchOperation{
+		{Op: "remove", Path: "/list/0"},
+		{Op: "add", Path: "/list/0", Value: map[string]any{"object": "Test", "name": "w"}},
+		{Op: "move", From: "/list/0", Path: "/list/-"},
+	})
+	if err != nil {
+		t.Fatalf("ApplyJSONPatch() error = %v", err)
+	}
+	if GetObj[*testObject](tree.Root().Get("list/0")) != y || GetObj[*testObject](tree.Root().Get("list/1")) != z || y.Name != "y" {
+		t.Errorf("list = %v", tree.Root().GetOne("list").Value())
+	}
+	if want := []string{"destroyed /list/0", "created /list/2"}; !reflect.DeepEqual(*events, want) {
+		t.Errorf("events = %v, want %v", *events, want)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	oldValue := map[string]any{
+		"a":     map[string]any{"x": 1, "y": 2},
+		"items": []any{1, 2, 3},
+		"same":  []any{map[string]any{"k": "v"}},
+		"b":     "text",
+	}
+	newValue := map[string]any{
+		"a":     map[string]any{"x": 1, "z": 3},
+		"items": []any{1, 5},
+		"same":  []any{map[string]any{"k": "v"}},
+		"b":     []any{"text"},
+	}
+
+	patch, changes := Diff(oldValue, newValue)
+
+	got := []string{}
+	for _, c := range changes {
+		got = append(got, c.String())
+	}
+	want := []string{
+		"- /a/y: 2",
+		"+ /a/z: 3",
+		"! /b: text -> [text]",
+		"~ /items/1: 2 -> 5",
+		"- /items/2: 3",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Diff() changes = %v, want %v", got, want)
+	}
+
+	tree := New()
+	tree.Set(oldValue)
+	tree.Set(patch)
+	if got := tree.GetValue(); !reflect.DeepEqual(got, newValue) {
+		t.Errorf("GetValue() after patch = %v, want %v", got, newValue)
+	}
+	if patch, changes := tree.DiffWith(newValue); patch != nil || len(changes) > 0 {
+		t.Errorf("DiffWith() = %v, %v, want no changes", patch, changes)
+	}
+}
+
+func TestDiffSlices(t *testing.T) {
+	item := map[string]any{"a": 1, "b": map[string]any{"c": 2}}
+	for _, c := range []struct {
+		oldValue any
+		newValue any
+		patch    any
+	}{
+		{[]any{item, "x", 3}, []any{item, "y"}, map[string]any{"1": "y", "2": Delete}},
+		{[]any{item, 2}, []any{item, 3, 4}, []any{map[string]any{}, 3, 4}},
+	} {
+		patch, _ := Diff(c.oldValue, c.newValue)
+		if !reflect.DeepEqual(patch, c.patch) {
+			t.Errorf("Diff() patch = %v, want %v", patch, c.patch)
+		}
+		tree := New()
+		tree.Set(c.oldValue)
+		tree.Set(patch)
+		if got := tree.GetValue(); !reflect.DeepEqual(got, c.newValue) {
+			t.Errorf("GetValue() after patch %v = %v, want %v", patch, got, c.newValue)
+		}
+	}
+}
+
+func TestDiffTypeChange(t *testing.T) {
+	for _, c := range []struct {
+		oldValue any
+		newValue any
+	}{
+		{map[string]any{"c": []any{1, 2, 3}}, map[string]any{"c": map[string]any{"0": "x"}}},
+		{map[string]any{"c": []any{1, 2, 3}}, map[string]any{"c": map[string]any{}}},
+		{map[string]any{"c": map[string]any{"0": "x", "k": 1}}, map[string]any{"c": []any{"y"}}},
+		{[]any{1, 2}, map[string]any{"1": 3}},
+	} {
+		patch, _ := Diff(c.oldValue, c.newValue)
+		tree := New()
+		tree.Set(c.oldValue)
+		tree.Set(patch)
+		if got := tree.GetValue(); !reflect.DeepEqual(got, c.newValue) {
+			t.Errorf("GetValue() after patch %v = %v, want %v", patch, got, c.newValue)
+		}
+	}
+}
+
+func TestSnapshotRevert(t *testing.T) {
+	tree, events := newTestTree()
+	tree.Set(map[string]any{
+		"a":     map[string]any{"object": "Test", "name": "a"},
+		"items": []any{1, 2},
+	})
+	s := tree.Snapshot()
+	if s.Version() != 1 || tree.Version() != 1 {
+		t.Errorf("Version() = %d, snapshot version = %d, want 1", tree.Version(), s.Version())
+	}
+
+	tree.Set(map[string]any{
+		"a":     Delete,
+		"b":     map[string]any{"object": "Test", "name": "b"},
+		"items": []any{3},
+	})
+	tree.Set(map[string]any{"b": map[string]any{"name": "b"}})
+	if tree.Version() != 2 {
+		t.Errorf("Version() = %d, want 2", tree.Version())
+	}
+	if n := s.GetOne("/items/1"); n == nil || n.Value() != 2 {
+		t.Errorf("snapshot GetOne() = %v", n)
+	}
+	func() {
+		defer func() {
+			if r := recover(); r != ErrReadOnly {
+				t.Errorf("snapshot node Set() panic = %v, want %v", r, ErrReadOnly)
+			}
+		}()
+		s.Root().Set(map[string]any{"items": nil})
+	}()
+	if s.GetOne("items").NodeType() != NodeTypeSlice {
+		t.Error("snapshot should be read-only")
+	}
+
+	*events = nil
+	if err := tree.Revert(s); err != nil {
+		t.Fatalf("Revert() error = %v", err)
+	}
+	if got := tree.GetValue(); !reflect.DeepEqual(got, s.Value()) {
+		t.Errorf("GetValue() = %v, want %v", got, s.Value())
+	}
+	if !reflect.DeepEqual(*events, []string{"destroyed /b", "created /a"}) && !reflect.DeepEqual(*events, []string{"created /a", "destroyed /b"}) {
+		t.Errorf("events = %v", *events)
+	}
+	if tree.Version() != 3 {
+		t.Errorf("Version() = %d, want 3", tree.Version())
+	}
+}
+
+func TestSnapshotTransaction(t *testing.T) {
+	tree := New()
+	tree.Set(map[string]any{"a": map[string]any{"x": 1}, "b": []any{1, 2}})
+	s := tree.Snapshot()
+
+	tree.Begin()
+	tree.Set(map[string]any{"a": map[string]any{"x": 2, "y": 3}, "b": map[string]any{"0": Delete}})
+	tree.Rollback()
+	if tree.Version() != 1 {
+		t.Errorf("Version() after Rollback = %d, want 1", tree.Version())
+	}
+
+	tree.Begin()
+	tree.Set(map[string]any{"a": Delete, "c": 1})
+	tree.Set(map[string]any{"b": []any{3}})
+	tree.Commit()
+	if tree.Version() != 2 {
+		t.Errorf("Version() after Commit = %d, want 2", tree.Version())
+	}
+
+	want := map[string]any{"a": map[string]any{"x": 1}, "b": []any{1, 2}}
+	if got := s.Value(); !reflect.DeepEqual(got, want) {
+		t.Errorf("snapshot Value() = %v, want %v", got, want)
+	}
+	if err := tree.Revert(s); err != nil {
+		t.Fatalf("Revert() error = %v", err)
+	}
+	if got := tree.GetValue(); !reflect.DeepEqual(got, want) {
+		t.Errorf("GetValue() after Revert = %v, want %v", got, want)
+	}
+}
+
+func TestUndoRedo(t *testing.T) {
+	tree, _ := newTestTree()
+	tree.EnableHistory(10)
+
+	states := []any{}
+	tree.Set(map[string]any{"a": map[string]any{"object": "Test", "name": "a"}, "items": []any{1, 2, 3}})
+	states = append(states, CloneValue(tree.GetValue()))
+
+	tree.Set(map[string]any{"a": map[string]any{"name": "b"}, "items": map[string]any{"1": Delete}})
+	states = append(states, CloneValue(tree.GetValue()))
+
+	tree.BeginHistoryGroup()
+	tree.Set(map[string]any{"a": Delete})
+	tree.Set(map[string]any{"b": []any{map[string]any{"x": 1}}})
+	tree.EndHistoryGroup()
+	states = append(states, CloneValue(tree.GetValue()))
+
+	if h := tree.History(); len(h) != 3 || len(h[2].Patches) != 2 {
+		t.Fatalf("History() = %v", h)
+	}
+
+	for i := len(states) - 2; i >= 0; i-- {
+		if err := tree.Undo(); err != nil {
+			t.Fatalf("Undo() error = %v", err)
+		}
+		if got := tree.GetValue(); !reflect.DeepEqual(got, states[i]) {
+			t.Errorf("GetValue() after undo = %v, want %v", got, states[i])
+		}
+	}
+	if obj := GetObj[*testObject](tree.Root().Get("a")); obj == nil || obj.Name != "a" {
+		t.Errorf("object is not restored by undo: %v", obj)
+	}
+
+	for i := 1; i < len(states); i++ {
+		if err := tree.Redo(); err != nil {
+			t.Fatalf("Redo() error = %v", err)
+		}
+		if got := tree.GetValue(); !reflect.DeepEqual(got, states[i]) {
+			t.Errorf("GetValue() after redo = %v, want %v", got, states[i])
+		}
+	}
+	if tree.Redo() == nil {
+		t.Error("Redo() error expected")
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	tree, _ := newTestTree()
+	tree.Set(map[string]any{
+		"services": map[string]any{
+			"a": map[string]any{"object": "Test", "value": 1},
+			"b": map[string]any{"value": 2},
+		},
+	})
+
+	got := []string{}
+	unsubscribe := tree.Subscribe("/services/*[object=Test]", func(e ChangeEvent) {
+		got = append(got, e.String())
+	})
+
+	tree.Set(map[string]any{"services": map[string]any{
+		"a": map[string]any{"value": 5},
+		"b": map[string]any{"value": 6},
+		"c": map[string]any{"object": "Test"},
+	}})
+	tree.Set(map[string]any{"services": map[string]any{"a": Delete}})
+
+	tree.Begin()
+	tree.Set(map[string]any{"services": map[string]any{"c": map[string]any{"value": 1}}})
+	tree.Rollback()
+
+	unsubscribe()
+	tree.Set(map[string]any{"services": map[string]any{"c": map[string]any{"value": 2}}})
+
+	want := []string{
+		"~ /services/a/value: 1 -> 5",
+		"+ /services/c: map[object:Test]",
+		"- /services/a: map[object:Test value:5]",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("events = %v, want %v", got, want)
+	}
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	tree, _ := newTestTree()
+	tree.Set(map[string]any{"items": map[string]any{}})
+
+	done := make(chan bool)
+	for r := 0; r < 4; r++ {
+		go func(r int) {
+			for i := 0; i < 200; i++ {
+				tree.Root().Get("/items/*")
+				tree.GetValue()
+				tree.Watch(strconv.Itoa(r))
+				tree.Root().Query("/items/*[object=Test]")
+			}
+			done <- true
+		}(r)
+	}
+
+	for i := 0; i < 200; i++ {
+		key := strconv.Itoa(i % 10)
+		tree.Set(map[string]any{"items": map[string]any{
+			key: map[string]any{"object": "Test", "value": i},
+		}})
+
+		v := tree.Root().GetOne("/items/" + key + "/value")
+		if v == nil || v.Value() != i {
+			t.Fatalf("GetOne() = %v, want %d", v, i)
+		}
+	}
+
+	for r := 0; r < 4; r++ {
+		<-done
+	}
+}
+
+// callbackObject runs the functions in Created and Destroyed
+type callbackObject struct {
+	node      Node
+	created   func(n Node)
+	destroyed func(n Node)
+}
+
+func (o *callbackObject) GetNode() Node    { return o.node }
+func (o *callbackObject) Created()         { o.created(o.node) }
+func (o *callbackObject) CreatedChildren() {}
+func (o *callbackObject) CreatedTree()     {}
+func (o *callbackObject) Destroyed() {
+	if o.destroyed != nil {
+		o.destroyed(o.node)
+	}
+}
+func (o *callbackObject) Updated(field string, value any) {}
+
+func TestCallbacksUnlocked(t *testing.T) {
+	tree := New()
+	tree.AddType(func(n Node) Object {
+		return &callbackObject{node: n, created: func(n Node) {
+			// Another goroutine reads the tree while the callback waits for it
+			done := make(chan any)
+			go func() {
+				done <- n.Tree().GetValue()
+			}()
+			<-done
+
+			// A read under a read lock is followed by a write
+			if n.GetOne("/a/status") == nil {
+				n.Set(map[string]any{"status": "created"})
+			}
+		}}
+	}, "Callback")
+
+	finished := make(chan *SetResult)
+	go func() {
+		finished <- tree.Set(map[string]any{"a": map[string]any{"object": "Callback"}})
+	}()
+	select {
+	case res := <-finished:
+		if err := res.Err(); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Set is deadlocked")
+	}
+
+	if v := tree.Root().GetOne("/a/status"); v == nil || v.Value() != "created" {
+		t.Errorf("status = %v", v)
+	}
+}
+
+func TestTransactionDoesNotBlockReaders(t *testing.T) {
+	tree, _ := newTestTree()
+	tree.Set(map[string]any{"a": 1})
+
+	if err := tree.Begin(); err != nil {
+		t.Fatal(err)
+	}
+	tree.Set(map[string]any{"a": 2})
+
+	read := make(chan any)
+	go func() {
+		read <- tree.GetValue()
+	}()
+	select {
+	case v := <-read:
+		if !reflect.DeepEqual(v, map[string]any{"a": 2}) {
+			t.Errorf("GetValue() = %v", v)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("GetValue is blocked by the transaction")
+	}
+
+	// Set calls of other goroutines become a part of the transaction
+	go func() {
+		read <- tree.Set(map[string]any{"b": 1})
+	}()
+	<-read
+	if err := tree.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if v := tree.GetValue(); !reflect.DeepEqual(v, map[string]any{"a": 1}) {
+		t.Errorf("GetValue() = %v after Rollback", v)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	tree, events := newTestTree()
+	tree.Set(map[string]any{
+		"a":     map[string]any{"object": "Test", "name": "a", "value": 1},
+		"items": []any{1, 2, 3},
+	})
+	*events = nil
+
+	patches := []any{
+		map[string]any{"a": Delete},
+		map[string]any{"a": map[string]any{"object": "Test", "name": "a2"}},
+		map[string]any{"items": map[string]any{"0": Delete}},
+		map[string]any{"items": map[string]any{"0": 5}},
+		map[string]any{"b": map[string]any{"object": "Test"}},
+	}
+
+	sequential := New()
+	sequential.Set(tree.GetValue())
+	for _, p := range patches {
+		sequential.Set(p)
+	}
+
+	tree.EnableHistory(0)
+	before := tree.GetValue()
+	versionBefore := tree.Version()
+	tree.Batch(func(b *Batch) {
+		for _, p := range patches[:4] {
+			b.Set(p)
+		}
+
+		// The tree is not locked while the patches are collected
+		if tree.Root().GetOne("b") == nil {
+			b.SetPath("/b/object", "Test")
+		}
+	})
+
+	if got, want := tree.GetValue(), sequential.GetValue(); !reflect.DeepEqual(got, want) {
+		t.Errorf("GetValue() = %v, want %v", got, want)
+	}
+	if tree.Version() != versionBefore+1 {
+		t.Errorf("Version() = %d, want a single change", tree.Version())
+	}
+	// The deleted and added again object is recreated as with sequential Set calls
+	if len(*events) != 3 || (*events)[0] != "destroyed /a" {
+		t.Errorf("events = %v", *events)
+	}
+	if obj := GetObj[*testObject](tree.Root().Get("a")); obj == nil || obj.Name != "a2" || obj.Value != nil {
+		t.Errorf("object is not updated: %v", obj)
+	}
+
+	// The batch is a single undo step
+	if err := tree.Undo(); err != nil {
+		t.Fatal(err)
+	}
+	if got := tree.GetValue(); !reflect.DeepEqual(got, before) || tree.CanUndo() {
+		t.Errorf("GetValue() = %v after Undo, want %v", got, before)
+	}
+}
+
+func TestSetResult(t *testing.T) {
+	tree, _ := newTestTree()
+	tree.Set(map[string]any{
+		"a": map[string]any{"object": "Test"},
+		"b": map[string]any{"object": "Test"},
+	})
+
+	r := tree.Set(map[string]any{
+		"a": map[string]any{"name": "x"},
+		"b": Delete,
+		"c": map[string]any{"object": "Test", "name": "c", "value": 1},
+		"d": map[string]any{"object": "Unknown"},
+	})
+
+	// The fields of a new object are set before Created, it is reported as created only
+	if !reflect.DeepEqual(r.Created, []ObjectInfo{{"/c", "Test"}}) {
+		t.Errorf("Created = %v", r.Created)
+	}
+	if !reflect.DeepEqual(r.Destroyed, []ObjectInfo{{"/b", "Test"}}) {
+		t.Errorf("Destroyed = %v", r.Destroyed)
+	}
+	if !reflect.DeepEqual(r.Updated, []ObjectInfo{{"/a", "Test"}}) {
+		t.Errorf("Updated = %v", r.Updated)
+	}
+	if !reflect.DeepEqual(r.UnknownTypes, []ObjectInfo{{"/d", "Unknown"}}) {
+		t.Errorf("UnknownTypes = %v", r.UnknownTypes)
+	}
+	if len(r.Modified) != 9 || r.Modified[0] != "" || r.Err() != nil {
+		t.Errorf("Modified = %v, Err() = %v", r.Modified, r.Err())
+	}
+
+	// Errors of the lifecycle callbacks are reported
+	r = tree.Set(map[string]any{"e": map[string]any{"object": "Test", "name": "panic"}})
+	var panicErr *PanicError
+	if len(r.Errors) != 1 || !errors.As(r.Err(), &panicErr) || len(r.Created) != 0 {
+		t.Errorf("Errors = %v, Created = %v", r.Errors, r.Created)
+	}
+
+	if err := tree.Snapshot().Root().Tree().Set(map[string]any{"a": 1}).Err(); !errors.Is(err, ErrReadOnly) {
+		t.Errorf("Set() on snapshot error = %v", err)
+	}
+}
+
+type taggedObject struct {
+	testObject
+
+	MaxRetries int     `forji:"max-retries,default=3"`
+	Port       int     `forji:"http_port,required"`
+	Host       string  `json:"host_name,omitempty"`
+	Ratio      float64 `forji:",omitempty,default=0.5"`
+	Skipped    string  `forji:"-"`
+}
+
+func TestStructTags(t *testing.T) {
+	tree, events := newTestTree()
+	tree.AddType(func(n Node) Object {
+		return &taggedObject{testObject: testObject{node: n, events: events}}
+	}, "Tagged")
+
+	res := tree.Set(map[string]any{
+		"a": map[string]any{"object": "Tagged", "http_port": 8080, "host_name": "localhost", "ratio": 0, "skipped": "x"},
+		"b": map[string]any{"object": "Tagged"},
+	})
+
+	a := GetObj[*taggedObject](tree.Root().Get("a"))
+	if a == nil || a.MaxRetries != 3 || a.Port != 8080 || a.Host != "localhost" || a.Ratio != 0.5 || a.Skipped != "" {
+		t.Fatalf("a = %+v", a)
+	}
+	if b := GetObj[*taggedObject](tree.Root().Get("b")); b != nil {
+		t.Errorf("object without required fields is created: %+v", b)
+	}
+	var objErr *ObjectError
+	if len(res.Errors) != 1 || !errors.As(res.Errors[0], &objErr) || objErr.Path != "/b" {
+		t.Fatalf("Errors = %v", res.Errors)
+	}
+	// The object without the required fields is destroyed without being created
+	if !reflect.DeepEqual(*events, []string{"destroyed /b", "created /a"}) {
+		t.Errorf("events = %v", *events)
+	}
+
+	// The object is created once the required field is set
+	tree.Set(map[string]any{"b": map[string]any{"http_port": 80}})
+	if b := GetObj[*taggedObject](tree.Root().Get("b")); b == nil || b.Port != 80 || b.MaxRetries != 3 {
+		t.Errorf("b = %+v", b)
+	}
+
+	// Removed keys get their defaults back
+	tree.Set(map[string]any{"a": map[string]any{"max-retries": 5}})
+	tree.Set(map[string]any{"a": map[string]any{"max-retries": Delete}})
+	if a.MaxRetries != 3 {
+		t.Errorf("MaxRetries = %d, want 3", a.MaxRetries)
+	}
+}
+
+type testEndpoint struct {
+	Host    string
+	Port    int `forji:"port,default=80"`
+	Timeout time.Duration
+}
+
+type testLevel int
+
+func (l *testLevel) UnmarshalText(text []byte) error {
+	switch string(text) {
+	case "low":
+		*l = 1
+	case "high":
+		*l = 2
+	default:
+		return errors.New("unknown level " + string(text))
+	}
+	return nil
+}
+
+type decodedObject struct {
+	testObject
+
+	Endpoint  testEndpoint
+	Fallback  *testEndpoint
+	Tags      []string
+	Weights   map[string]float64
+	Ports     map[int]bool
+	Interval  time.Duration
+	StartedAt time.Time
+	Level     testLevel
+	Backups   []testEndpoint `forji:"backups,default=[{\"host\":\"b1\"}]"`
+}
+
+func TestDeepDecode(t *testing.T) {
+	tree, events := newTestTree()
+	tree.AddType(func(n Node) Object {
+		return &decodedObject{testObject: testObject{node: n, events: events}}
+	}, "Decoded")
+
+	res := tree.Set(map[string]any{
+		"a": map[string]any{
+			"object":    "Decoded",
+			"endpoint":  map[string]any{"host": "localhost", "timeout": "5s"},
+			"fallback":  map[string]any{"host": "remote", "port": 8080.0},
+			"tags":      []any{"x", "y"},
+			"weights":   map[string]any{"a": 1, "b": 0.5},
+			"ports":     map[string]any{"80": true},
+			"interval":  "1m30s",
+			"startedAt": "2024-01-02T03:04:05Z",
+			"level":     "high",
+		},
+	})
+	if err := res.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	a := GetObj[*decodedObject](tree.Root().Get("a"))
+	want := &decodedObject{
+		testObject: a.testObject,
+		Endpoint:   testEndpoint{Host: "localhost", Port: 80, Timeout: 5 * time.Second},
+		Fallback:   &testEndpoint{Host: "remote", Port: 8080},
+		Tags:       []string{"x", "y"},
+		Weights:    map[string]float64{"a": 1, "b": 0.5},
+		Ports:      map[int]bool{80: true},
+		Interval:   90 * time.Second,
+		StartedAt:  time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+		Level:      2,
+		Backups:    []testEndpoint{{Host: "b1", Port: 80}},
+	}
+	if !reflect.DeepEqual(a, want) {
+		t.Errorf("a = %+v, want %+v", a, want)
+	}
+
+	res = tree.Set(map[string]any{"a": map[string]any{"level": "medium", "tags": []any{1}}})
+	if len(res.Errors) != 2 {
+		t.Errorf("Errors = %v", res.Errors)
+	}
+}
+
+type publisherObject struct {
+	testObject
+
+	Status  string        `forji:"status,output"`
+	Uptime  time.Duration `forji:"uptime,output"`
+	updated []string
+}
+
+func (o *publisherObject) Created() {
+	o.Status = "running"
+}
+
+func (o *publisherObject) Updated(field string, value any) {
+	o.updated = append(o.updated, field)
+}
+
+func TestPublish(t *testing.T) {
+	tree, events := newTestTree()
+	tree.AddType(func(n Node) Object {
+		return &publisherObject{testObject: testObject{node: n, events: events}}
+	}, "Publisher")
+	tree.Watch("w")
+
+	tree.Set(map[string]any{"a": map[string]any{"object": "Publisher", "name": "a"}})
+	a := GetObj[*publisherObject](tree.Root().Get("a"))
+	if !reflect.DeepEqual(a.updated, []string{"name"}) {
+		t.Errorf("fields of the new object are set more than once: %v", a.updated)
+	}
+	want := map[string]any{"a": map[string]any{"object": "Publisher", "name": "a", "status": "running", "uptime": "0s"}}
+	if got := tree.GetValue(); !reflect.DeepEqual(got, want) {
+		t.Errorf("GetValue() = %v, want %v", got, want)
+	}
+
+	a.updated = nil
+	a.GetNode().Publish("connections", 2)
+	if got := tree.Root().GetOne("a/connections").Value(); got != 2 {
+		t.Errorf("connections = %v", got)
+	}
+	if len(a.updated) != 0 {
+		t.Errorf("published values looped back into Updated: %v", a.updated)
+	}
+
+	// Output fields are not set from the tree, the object value is published back
+	tree.Set(map[string]any{"a": map[string]any{"status": "stopped", "name": "b"}})
+	if got := tree.Root().GetOne("a/status").Value(); got != "running" {
+		t.Errorf("status = %v", got)
+	}
+	if a.Status != "running" || !reflect.DeepEqual(a.updated, []string{"status", "name"}) && !reflect.DeepEqual(a.updated, []string{"name", "status"}) {
+		t.Errorf("Status = %s, updated = %v", a.Status, a.updated)
+	}
+
+	changes, _ := tree.Watch("w").(map[string]any)
+	if aChanges, _ := changes["a"].(map[string]any); aChanges["connections"] != 2 || aChanges["name"] != "b" {
+		t.Errorf("watcher changes = %v", changes)
+	}
+}
+
+func TestSetStateIsolation(t *testing.T) {
+	tree, events := newTestTree()
+	tree.AddType(func(n Node) Object {
+		return &publisherObject{testObject: testObject{node: n, events: events}}
+	}, "Publisher")
+
+	// setConcurrently makes a Set in another goroutine while the Set in progress calls the objects
+	var patch any
+	setConcurrently := func() {
+		if patch != nil {
+			done := make(chan any)
+			go func() {
+				done <- tree.Set(patch)
+			}()
+			<-done
+			patch = nil
+		}
+	}
+	tree.AddType(func(n Node) Object {
+		return &callbackObject{node: n, created: func(n Node) {
+			setConcurrently()
+		}}
+	}, "Callback")
+
+	// A rolled back SetTx keeps the Set of another goroutine
+	tree.Set(map[string]any{"x": 0})
+	patch = map[string]any{"other": 1}
+	err := tree.SetTx(map[string]any{
+		"a": map[string]any{"object": "Callback"},
+		"b": map[string]any{"object": "Test", "name": "panic"},
+	})
+	if want := map[string]any{"x": 0, "other": 1}; err == nil || !reflect.DeepEqual(tree.GetValue(), want) {
+		t.Errorf("SetTx() = %v, GetValue() = %v, want %v", err, tree.GetValue(), want)
+	}
+
+	// A Set made during Undo is recorded
+	tree.EnableHistory(0)
+	tree.Set(map[string]any{"a": map[string]any{"object": "Callback"}})
+	tree.Set(map[string]any{"a": Delete})
+	patch = map[string]any{"other": 2}
+	if err := tree.Undo(); err != nil {
+		t.Fatalf("Undo() error = %v", err)
+	}
+	if h := tree.History(); len(h) != 2 || !reflect.DeepEqual(h[1].Patches, []any{map[string]any{"other": 2}}) {
+		t.Errorf("History() = %v", h)
+	}
+	tree.DisableHistory()
+
+	// A Set made while an object publishes updates the object
+	tree.Set(map[string]any{"p": map[string]any{"object": "Publisher"}})
+	p := GetObj[*publisherObject](tree.Root().Get("p"))
+	p.updated = nil
+	unsubscribe := tree.Subscribe("/p/connections", func(e ChangeEvent) {
+		patch = map[string]any{"p": map[string]any{"name": "p"}}
+		setConcurrently()
+	})
+	defer unsubscribe()
+	p.GetNode().Publish("connections", 2)
+	if !reflect.DeepEqual(p.updated, []string{"name"}) {
+		t.Errorf("updated = %v, want [name]", p.updated)
+	}
+}
+
+func TestRemovedDuringCallbacks(t *testing.T) {
+	tree, events := newTestTree()
+
+	// setConcurrently makes a Set in another goroutine while the Set in progress calls the objects
+	var patch any
+	setConcurrently := func() {
+		if patch != nil {
+			done := make(chan any)
+			go func() {
+				done <- tree.Set(patch)
+			}()
+			<-done
+			patch = nil
+		}
+	}
+	tree.AddType(func(n Node) Object {
+		setConcurrently()
+		return &testObject{node: n, events: events}
+	}, "Remover")
+	tree.AddType(func(n Node) Object {
+		return &callbackObject{node: n, created: func(n Node) {}, destroyed: func(n Node) {
+			setConcurrently()
+		}}
+	}, "Callback")
+
+	// The child removed by the constructor of its parent gets no object
+	patch = map[string]any{"p": map[string]any{"c": Delete}}
+	tree.Set(map[string]any{"p": map[string]any{"object": "Remover", "c": map[string]any{"object": "Test"}}})
+	if want := []string{"created /p"}; !reflect.DeepEqual(*events, want) {
+		t.Errorf("events = %v, want %v", *events, want)
+	}
+
+	// The object of the node removed by its own constructor is destroyed
+	*events = nil
+	patch = map[string]any{"q": Delete}
+	tree.Set(map[string]any{"q": map[string]any{"object": "Remover"}})
+	if want := []string{"destroyed /q"}; !reflect.DeepEqual(*events, want) || tree.Root().GetOne("q") != nil {
+		t.Errorf("events = %v, want %v", *events, want)
+	}
+
+	// The Set made while Clear destroys the objects is applied to the cleared tree
+	tree.Set(map[string]any{"r": map[string]any{"object": "Callback"}})
+	patch = map[string]any{"x": map[string]any{"object": "Test"}}
+	*events = nil
+	tree.Clear()
+	if want := map[string]any{"x": map[string]any{"object": "Test"}}; !reflect.DeepEqual(tree.GetValue(), want) {
+		t.Errorf("GetValue() = %v, want %v", tree.GetValue(), want)
+	}
+	if obj := GetObj[*testObject](tree.Root().Get("x")); obj == nil || len(*events) != 2 || !slices.Contains(*events, "created /x") {
+		t.Errorf("object = %v, events = %v", obj, *events)
+	}
+}
+
+type validatedObject struct {
+	testObject
+
+	Port int
+}
+
+func (o *validatedObject) Validate() error {
+	if o.Port == 13 {
+		panic("unlucky port")
+	}
+	if o.Port <= 0 {
+		return errors.New("port should be positive")
+	}
+	return nil
+}
+
+func TestValidator(t *testing.T) {
+	tree, events := newTestTree()
+	tree.AddType(func(n Node) Object {
+		return &validatedObject{testObject: testObject{node: n, events: events}}
+	}, "Validated")
+
+	res := tree.Set(map[string]any{"a": map[string]any{"object": "Validated", "port": -1}})
+	var objErr *ObjectError
+	if len(res.Errors) != 1 || !errors.As(res.Err(), &objErr) || objErr.Path != "/a" || objErr.Type != "Validated" {
+		t.Fatalf("Errors = %v", res.Errors)
+	}
+	if !reflect.DeepEqual(*events, []string{"destroyed /a"}) || len(res.Created) != 0 || len(res.Destroyed) != 0 || GetObj[*validatedObject](tree.Root().Get("a")) != nil {
+		t.Errorf("invalid object is created: %v", *events)
+	}
+	if err := tree.SetTx(map[string]any{"b": map[string]any{"object": "Validated"}}); err == nil || tree.Root().GetOne("b") != nil {
+		t.Errorf("SetTx() = %v, b = %v", err, tree.Root().GetOne("b"))
+	}
+
+	// Validation is retried on the next patch
+	*events = nil
+	res = tree.Set(map[string]any{"a": map[string]any{"port": 80}})
+	if err := res.Err(); err != nil || !reflect.DeepEqual(*events, []string{"created /a"}) {
+		t.Errorf("Err() = %v, events = %v", err, *events)
+	}
+
+	// A panic in Validate fails the node until the object is valid
+	res = tree.Set(map[string]any{"c": map[string]any{"object": "Validated", "port": 13}})
+	var panicErr *PanicError
+	if len(res.Errors) != 1 || !errors.As(res.Err(), &panicErr) || panicErr.Callback != "Validate" || tree.Root().GetOne("c").Err() == nil {
+		t.Fatalf("Errors = %v", res.Errors)
+	}
+	res = tree.Set(map[string]any{"c": map[string]any{"port": 81}})
+	if err := res.Err(); err != nil || tree.Root().GetOne("c").Err() != nil || GetObj[*validatedObject](tree.Root().Get("c")) == nil {
+		t.Errorf("Err() = %v, node Err() = %v", err, tree.Root().GetOne("c").Err())
+	}
+}
+
+type panickingObject struct {
+	testObject
+}
+
+func (o *panickingObject) Updated(field string, value any) {
+	if field == "name" && value == "bad" {
+		panic("bad name")
+	}
+}
+
+func (o *panickingObject) Destroyed() { panic("cannot destroy") }
+
+func TestPanicIsolation(t *testing.T) {
+	tree, events := newTestTree()
+	tree.AddType(func(n Node) Object {
+		return &panickingObject{testObject: testObject{node: n, events: events}}
+	}, "Panicking")
+	handled := []*ObjectError{}
+	tree.SetErrorHandler(func(err *ObjectError) {
+		handled = append(handled, err)
+	})
+
+	res := tree.Set(map[string]any{
+		"a": map[string]any{"object": "Test", "name": "panic"},
+		"b": map[string]any{"object": "Panicking", "name": "b"},
+	})
+	var panicErr *PanicError
+	if len(res.Errors) != 1 || !errors.As(res.Errors[0], &panicErr) || panicErr.Callback != "Created" || len(panicErr.Stack) == 0 {
+		t.Fatalf("Errors = %v", res.Errors)
+	}
+	if len(handled) != 1 || handled[0].Path != "/a" || handled[0].Type != "Test" {
+		t.Errorf("handled = %v", handled)
+	}
+	if err := tree.Root().GetOne("a").Err(); err == nil || GetObj[*testObject](tree.Root().Get("a")) != nil {
+		t.Errorf("Err() = %v", err)
+	}
+
+	res = tree.Set(map[string]any{"b": map[string]any{"name": "bad"}})
+	if len(res.Errors) != 1 || tree.Root().GetOne("b").Err() == nil {
+		t.Errorf("Errors = %v", res.Errors)
+	}
+	if GetObj[*panickingObject](tree.Root().Get("b")) == nil {
+		t.Error("object is destroyed after the failed update")
+	}
+
+	res = tree.Set(map[string]any{"b": Delete})
+	if len(res.Errors) != 1 || len(res.Destroyed) != 1 || tree.Root().GetOne("b") != nil {
+		t.Errorf("Errors = %v, Destroyed = %v", res.Errors, res.Destroyed)
+	}
+	if len(handled) != 3 {
+		t.Errorf("handled = %v", handled)
+	}
+
+	// An object which panics while its fields are set is not created
+	res = tree.Set(map[string]any{"e": map[string]any{"object": "Panicking", "name": "bad"}})
+	if res.Err() == nil || len(res.Created) != 0 || GetObj[*panickingObject](tree.Root().Get("e")) != nil {
+		t.Errorf("Errors = %v, Created = %v", res.Errors, res.Created)
+	}
+	if !errors.As(res.Errors[0], &panicErr) || panicErr.Callback != "Updated" || tree.Root().GetOne("e").Err() == nil {
+		t.Errorf("Errors = %v", res.Errors)
+	}
+	res = tree.Set(map[string]any{"e": map[string]any{"name": "e"}})
+	if len(res.Created) != 1 || tree.Root().GetOne("e").Err() != nil {
+		t.Errorf("Errors = %v, Created = %v", res.Errors, res.Created)
+	}
+
+	// A panic of the error handler interrupts the Set, the outputs of the interrupted change are not published
+	tree.AddType(func(n Node) Object {
+		return &publisherObject{testObject: testObject{node: n, events: events}}
+	}, "Publisher")
+	tree.SetErrorHandler(func(err *ObjectError) {
+		panic(err)
+	})
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Error("Set doesn't panic")
+			}
+		}()
+		tree.Set(map[string]any{
+			"p": map[string]any{"object": "Publisher"},
+			"c": map[string]any{"object": "Test", "name": "panic"},
+		})
+	}()
+	if tree.Root().GetOne("p/status") != nil {
+		t.Error("outputs of the interrupted Set are published")
+	}
+	tree.SetErrorHandler(nil)
+	if err := tree.Set(map[string]any{"d": 1}).Err(); err != nil || tree.Root().GetOne("d") == nil {
+		t.Errorf("Set() after the panic = %v", err)
+	}
+}
+
+type configuredObject struct {
+	testObject
+
+	Port  int
+	Host  string
+	Extra map[string]any `forji:",extra"`
+}
+
+func TestObjectTypeOptions(t *testing.T) {
+	tree, events := newTestTree()
+	server := NewObjectType(func(n Node) Object {
+		return &configuredObject{testObject: testObject{node: n, events: events}}
+	}, "Server")
+	server.DefaultData = map[string]any{"port": 80, "host": "localhost"}
+	server.UnknownKeys = UnknownKeysStore
+	tree.AddObjectType(server)
+	if err := tree.AddDerivedType("Server", "SecureServer", map[string]any{"port": 443}); err != nil {
+		t.Fatal(err)
+	}
+	if err := tree.AddDerivedType("Unknown", "X", nil); err == nil {
+		t.Error("AddDerivedType() error expected for the unknown base type")
+	}
+
+	tree.Set(map[string]any{
+		"a": map[string]any{"object": "Server", "host": "example.com", "debug": true},
+		"b": map[string]any{"object": "SecureServer"},
+	})
+	a := GetObj[*configuredObject](tree.Root().Get("a"))
+	b := GetObj[*configuredObject](tree.Root().Get("b"))
+	if a.Port != 80 || a.Host != "example.com" || !reflect.DeepEqual(a.Extra, map[string]any{"debug": true}) {
+		t.Errorf("a = %+v", a)
+	}
+	if b.Port != 443 || b.Host != "localhost" || b.Extra != nil {
+		t.Errorf("b = %+v", b)
+	}
+
+	// Default data is restored for the removed keys
+	tree.Set(map[string]any{"a": map[string]any{"host": Delete, "debug": Delete}})
+	if a.Host != "localhost" || len(a.Extra) != 0 {
+		t.Errorf("a = %+v", a)
+	}
+
+	strict := NewObjectType(server.newObjectFunc, "Strict")
+	strict.UnknownKeys = UnknownKeysError
+	tree.AddObjectType(strict)
+	res := tree.Set(map[string]any{"c": map[string]any{"object": "Strict", "port": 1, "debug": true}})
+	if len(res.Errors) != 1 || res.Errors[0].Error() != "/c (Strict): unknown key debug" {
+		t.Errorf("Errors = %v", res.Errors)
+	}
+}
+
+func TestTypeObject(t *testing.T) {
+	tree, events := newTestTree()
+
+	res := tree.Set(map[string]any{
+		"a": map[string]any{"object": "Named"},
+		"types": map[string]any{
+			"Named": map[string]any{"object": "Type", "base": "Test", "name": "default"},
+		},
+	})
+	if err := res.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if a := GetObj[*testObject](tree.Root().Get("a")); a == nil || a.Name != "default" {
+		t.Fatalf("a = %v", a)
+	}
+
+	// Nodes are recreated with the changed defaults
+	*events = nil
+	tree.Set(map[string]any{"types": map[string]any{"Named": map[string]any{"name": "changed", "value": 1}}})
+	if a := GetObj[*testObject](tree.Root().Get("a")); a == nil || a.Name != "changed" || a.Value != 1 {
+		t.Errorf("a = %v", a)
+	}
+	if !reflect.DeepEqual(*events, []string{"destroyed /a", "created /a"}) {
+		t.Errorf("events = %v", *events)
+	}
+
+	*events = nil
+	tree.Set(map[string]any{"types": Delete})
+	if tree.GetType("Named") != nil || GetObj[*testObject](tree.Root().Get("a")) != nil {
+		t.Error("type is not unregistered")
+	}
+	if !reflect.DeepEqual(*events, []string{"destroyed /a"}) {
+		t.Errorf("events = %v", *events)
+	}
+
+	res = tree.Set(map[string]any{"b": map[string]any{"object": "Type", "base": "Unknown"}})
+	if len(res.Errors) != 1 || tree.GetType("b") != nil {
+		t.Errorf("Errors = %v", res.Errors)
+	}
+
+	// The objects created by a type declared later publish their outputs
+	tree.AddType(func(n Node) Object {
+		return &publisherObject{testObject: testObject{node: n, events: events}}
+	}, "Publisher")
+	tree.Set(map[string]any{"c": map[string]any{"object": "Running"}})
+	tree.Set(map[string]any{"types": map[string]any{"Running": map[string]any{"object": "Type", "base": "Publisher"}}})
+	if v := tree.Root().GetOne("c/status"); v == nil || v.Value() != "running" {
+		t.Errorf("status = %v", v)
+	}
+
+	// The Type object is not registered in the trees of the snapshots
+	s := tree.Snapshot()
+	if s.Root().Tree().GetType(TypeKeyword) != nil || GetObj[*TypeObject](s.Root().Get("types/Running")) != nil {
+		t.Error("snapshot tree has the Type object")
+	}
+}
+
+func TestLateTypes(t *testing.T) {
+	events := &[]string{}
+	tree := New()
+	newTest := func(n Node) Object {
+		return &testObject{node: n, events: events}
+	}
+	tree.Created()
+
+	res := tree.Set(map[string]any{
+		"a": map[string]any{"object": "Late", "name": "a", "b": map[string]any{"object": "Late", "name": "b"}},
+		"c": map[string]any{"object": "Other"},
+	})
+	if len(res.UnknownTypes) != 3 || len(*events) != 0 {
+		t.Fatalf("UnknownTypes = %v, events = %v", res.UnknownTypes, *events)
+	}
+
+	tree.AddType(newTest, "Late")
+	if !reflect.DeepEqual(*events, []string{"created /a", "created /a/b"}) {
+		t.Errorf("events = %v", *events)
+	}
+	if a := GetObj[*testObject](tree.Root().Get("a")); a == nil || a.Name != "a" {
+		t.Errorf("a = %v", a)
+	}
+
+	// Removed nodes are not instantiated
+	tree.Set(map[string]any{"c": Delete})
+	tree.AddType(newTest, "Other")
+	if len(*events) != 2 {
+		t.Errorf("events = %v", *events)
+	}
+
+	*events = nil
+	tree.RemoveType("Late")
+	if len(*events) != 2 || GetObj[*testObject](tree.Root().Get("a")) != nil {
+		t.Errorf("events = %v", *events)
+	}
+	if got := tree.Root().GetOne("a/name").Value(); got != "a" {
+		t.Errorf("node data is lost: %v", got)
+	}
+
+	*events = nil
+	tree.AddType(newTest, "Late")
+	if !reflect.DeepEqual(*events, []string{"created /a", "created /a/b"}) {
+		t.Errorf("events = %v", *events)
+	}
+}
+
+func TestAddTypes(t *testing.T) {
+	tree, events := newTestTree()
+	for _, name := range []string{"AddTypesApp", "AddTypesDb"} {
+		RegisteredTypes.RegisterType(func(n Node) Object {
+			return &testObject{node: n, events: events}
+		}, name)
+	}
+	tree.Set(map[string]any{
+		"app": map[string]any{"object": "AddTypesApp", "value": "@../db"},
+		"db":  map[string]any{"object": "AddTypesDb"},
+	})
+
+	// The types are added at once, so the dependencies are created first whatever the order of the types
+	if err := tree.AddTypes("AddTypesApp,AddTypesDb"); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"created /db", "created /app"}; !reflect.DeepEqual(*events, want) {
+		t.Errorf("events = %v, want %v", *events, want)
+	}
+}
+
+type dependentObject struct {
+	testObject
+}
+
+func (o *dependentObject) Dependencies() []string { return []string{"/cache"} }
+
+func TestDependencies(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		tree, events := newTestTree()
+		tree.AddType(func(n Node) Object {
+			return &dependentObject{testObject: testObject{node: n, events: events}}
+		}, "Dependent")
+
+		res := tree.Set(map[string]any{
+			"app":   map[string]any{"object": "Dependent", "value": "@../db"},
+			"db":    map[string]any{"object": "Test", "value": []any{"@/cache/config"}},
+			"cache": map[string]any{"object": "Test", "config": map[string]any{"size": 1}},
+		})
+		if err := res.Err(); err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{"created /cache", "created /db", "created /app"}; !reflect.DeepEqual(*events, want) {
+			t.Fatalf("events = %v, want %v", *events, want)
+		}
+
+		*events = nil
+		tree.Set(map[string]any{"app": Delete, "db": Delete, "cache": Delete})
+		if want := []string{"destroyed /app", "destroyed /db", "destroyed /cache"}; !reflect.DeepEqual(*events, want) {
+			t.Fatalf("events = %v, want %v", *events, want)
+		}
+
+		// Clear destroys the objects in the same order
+		tree.Set(map[string]any{
+			"app":   map[string]any{"object": "Dependent", "value": "@../db"},
+			"db":    map[string]any{"object": "Test", "value": []any{"@/cache/config"}},
+			"cache": map[string]any{"object": "Test", "config": map[string]any{"size": 1}},
+		})
+		*events = nil
+		tree.Clear()
+		if want := []string{"destroyed /app", "destroyed /db", "destroyed /cache"}; !reflect.DeepEqual(*events, want) {
+			t.Fatalf("events after Clear = %v, want %v", *events, want)
+		}
+	}
+
+	// Objects which depend on each other are reported and created anyway
+	tree, events := newTestTree()
+	res := tree.Set(map[string]any{
+		"x": map[string]any{"object": "Test", "value": "@../y"},
+		"y": map[string]any{"object": "Test", "value": "@../x"},
+		"z": map[string]any{"object": "Test", "value": "@../x"},
+	})
+	var cycleErr *DependencyCycleError
+	if len(res.Errors) != 2 || !errors.As(res.Err(), &cycleErr) || len(cycleErr.Paths) != 3 {
+		t.Fatalf("Errors = %v", res.Errors)
+	}
+	if len(*events) != 3 || (*events)[2] == "created /x" {
+		t.Errorf("events = %v", *events)
+	}
+
+	*events = nil
+	res = tree.Set(map[string]any{"x": Delete, "y": Delete, "z": Delete})
+	if err := res.Err(); err != nil || len(*events) != 3 || (*events)[0] == "destroyed /x" {
+		t.Errorf("Errors = %v, events = %v", res.Errors, *events)
+	}
+}
+
+type serviceObject struct {
+	testObject
+}
+
+func (o *serviceObject) Start(ctx context.Context) error {
+	if o.Name == "broken" {
+		return errors.New("cannot start")
+	}
+	o.log("start")
+	return nil
+}
+
+func (o *serviceObject) Stop(ctx context.Context) error {
+	o.log("stop")
+	if o.Name == "slow" {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+	return nil
+}
+
+// blockingService waits in Start until release is closed
+type blockingService struct {
+	callbackObject
+	starting chan bool
+	release  chan bool
+	stopped  chan bool
+}
+
+func (o *blockingService) Start(ctx context.Context) error {
+	o.starting <- true
+	<-o.release
+	return nil
+}
+
+func (o *blockingService) Stop(ctx context.Context) error {
+	o.stopped <- true
+	return nil
+}
+
+func TestShutdownWhileStarting(t *testing.T) {
+	tree := New()
+	starting, release, stopped := make(chan bool), make(chan bool), make(chan bool, 2)
+	tree.AddType(func(n Node) Object {
+		return &blockingService{
+			callbackObject: callbackObject{node: n, created: func(Node) {}},
+			starting:       starting,
+			release:        release,
+			stopped:        stopped,
+		}
+	}, "Blocking")
+	if err := tree.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	done := make(chan *SetResult)
+	go func() {
+		done <- tree.Set(map[string]any{"a": map[string]any{"object": "Blocking"}})
+	}()
+	<-starting
+	if err := tree.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	<-done
+
+	// The object is stopped once after its Start returns, deleting it doesn't stop it again
+	tree.Set(map[string]any{"a": Delete})
+	if len(stopped) != 1 {
+		t.Errorf("object is stopped %d times, want 1", len(stopped))
+	}
+}
+
+func TestStartShutdown(t *testing.T) {
+	tree, events := newTestTree()
+	tree.AddType(func(n Node) Object {
+		return &serviceObject{testObject: testObject{node: n, events: events}}
+	}, "Service")
+
+	tree.Set(map[string]any{
+		"api": map[string]any{"object": "Service", "value": "@../db"},
+		"db":  map[string]any{"object": "Service", "name": "slow"},
+	})
+	*events = nil
+
+	if err := tree.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"start /db", "start /api"}; !reflect.DeepEqual(*events, want) {
+		t.Errorf("events = %v, want %v", *events, want)
+	}
+
+	// Objects are started and stopped with the changes of the started tree
+	*events = nil
+	handled := []error{}
+	tree.SetErrorHandler(func(err *ObjectError) {
+		handled = append(handled, err)
+	})
+	res := tree.Set(map[string]any{
+		"worker": map[string]any{"object": "Service"},
+		"broken": map[string]any{"object": "Service", "name": "broken"},
+	})
+	if len(res.Errors) != 1 || len(*events) != 3 || (*events)[2] != "start /worker" {
+		t.Errorf("Errors = %v, events = %v", res.Errors, *events)
+	}
+	if len(handled) != 1 || handled[0].Error() != "/broken (Service): start: cannot start" {
+		t.Errorf("handled = %v", handled)
+	}
+	*events = nil
+	tree.Set(map[string]any{"worker": Delete, "broken": Delete})
+	want := []string{"stop /worker", "destroyed /worker"}
+	if len(*events) != 3 || !reflect.DeepEqual((*events)[:2], want) && !reflect.DeepEqual((*events)[1:], want) {
+		t.Errorf("events = %v", *events)
+	}
+
+	// Stop of the destroyed objects is limited by StopTimeout
+	defer func(timeout time.Duration) { StopTimeout = timeout }(StopTimeout)
+	StopTimeout = 10 * time.Millisecond
+	tree.Set(map[string]any{"slow": map[string]any{"object": "Service", "name": "slow"}})
+	res = tree.Set(map[string]any{"slow": Delete})
+	if !errors.Is(res.Err(), context.DeadlineExceeded) || len(handled) != 2 {
+		t.Errorf("Errors = %v, handled = %v", res.Errors, handled)
+	}
+
+	*events = nil
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	err := tree.Shutdown(ctx)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Shutdown() = %v", err)
+	}
+	if want := []string{"stop /api", "stop /db"}; !reflect.DeepEqual(*events, want) {
+		t.Errorf("events = %v, want %v", *events, want)
+	}
+	if tree.IsStarted() {
+		t.Error("tree is still started")
+	}
+}
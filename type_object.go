@@ -0,0 +1,115 @@
+package forjitree
+
+import "fmt"
+
+// TypeKeyword is the name of the built-in type which declares derived types in the tree data:
+//
+//	{"Button": {"object": "Type", "base": "Block", "color": "red"}}
+//
+// registers the type Button derived from Block with {"color": "red"} as the default data.
+const TypeKeyword = "Type"
+
+// TypeObject registers the type named by the key of its node while it exists.
+// The nodes which reference the type are synchronized when it is registered, changed or unregistered.
+type TypeObject struct {
+	node Node
+
+	Base string `forji:"base"`
+
+	name       string
+	registered *ObjectType
+	previous   *ObjectType
+}
+
+func NewTypeObject(n Node) Object {
+	return &TypeObject{node: n}
+}
+
+func (o *TypeObject) GetNode() Node { return o.node }
+
+func (o *TypeObject) Created() {
+	o.name = o.node.Name()
+	o.register()
+}
+
+func (o *TypeObject) CreatedChildren() {}
+func (o *TypeObject) CreatedTree()     {}
+
+func (o *TypeObject) Destroyed() {
+	t := o.node.internalNode().tree
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	o.unregister()
+}
+
+// Validate checks that the base type is registered before the type is created
+func (o *TypeObject) Validate() error {
+	if o.node.Tree().GetType(o.Base) == nil {
+		return fmt.Errorf("base type %s is not found", o.Base)
+	}
+	return nil
+}
+
+// Updated registers the type again, fields are set before Created as well, so the type is not registered until then
+func (o *TypeObject) Updated(field string, value any) {
+	if o.name != "" {
+		o.register()
+	}
+}
+
+// register is called by the callbacks, the tree is unlocked
+func (o *TypeObject) register() {
+	n := o.node.internalNode()
+	t := n.tree
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if o.registered == nil {
+		o.previous = t.objectTypes[o.name]
+	}
+
+	// A type can extend the type registered under the same name before
+	base, ok := t.objectTypes[o.Base]
+	if o.Base == o.name {
+		base, ok = o.previous, o.previous != nil
+	}
+	if !ok {
+		o.unregister()
+		n.fail(fmt.Errorf("base type %s is not found", o.Base))
+		return
+	}
+
+	defaultData := map[string]any{}
+	for k, v := range n.m {
+		if k != ObjectKeyword && k != "base" {
+			defaultData[k] = v.getValue()
+		}
+	}
+
+	// All changed keys of a patch are passed to Updated one by one, the type is registered again only once
+	if o.registered != nil && o.registered.Base == base.Name && t.objectTypes[o.name] == o.registered {
+		if _, changed := diffPatch(o.registered.DefaultData, base.Derive(o.name, defaultData).DefaultData); !changed {
+			return
+		}
+	}
+
+	o.registered = base.Derive(o.name, defaultData)
+	t.setType(o.name, o.registered)
+}
+
+func (o *TypeObject) unregister() {
+	if o.registered == nil {
+		return
+	}
+	t := o.node.internalNode().tree
+
+	// The type could have been replaced by another one
+	replaced := t.objectTypes[o.name] != o.registered
+	previous := o.previous
+	o.registered = nil
+	o.previous = nil
+	if !replaced {
+		t.setType(o.name, previous)
+	}
+}
@@ -1,8 +1,10 @@
 package forjitree
 
 import (
+	"context"
 	"crypto/rand"
 	"encoding/base64"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -12,6 +14,7 @@ import (
 	"strconv"
 	"strings"
 	"syscall"
+	"time"
 	"unicode"
 )
 
@@ -80,12 +83,32 @@ func MergeMaps(m1 map[string]any, m2 map[string]any) {
 	}
 }
 
+// ShutdownTimeout limits the graceful shutdown of the trees in WaitForInterruptionAndShutdown
+var ShutdownTimeout = 30 * time.Second
+
 func WaitForInterruption() {
 	quit := make(chan os.Signal, 1)
 	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(quit)
 	<-quit
 }
 
+// WaitForInterruptionAndShutdown blocks until SIGINT or SIGTERM is received, then shuts down the trees in reverse order
+func WaitForInterruptionAndShutdown(trees ...*Tree) error {
+	WaitForInterruption()
+
+	ctx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+
+	errs := []error{}
+	for i := len(trees) - 1; i >= 0; i-- {
+		if err := trees[i].Shutdown(ctx); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
 func RandString(nByte int) (string, error) {
 	b := make([]byte, nByte)
 	if _, err := io.ReadFull(rand.Reader, b); err != nil {
@@ -124,6 +147,17 @@ func CloneMap(m map[string]any) map[string]any {
 	return cp
 }
 
+func CloneValue(v any) any {
+	switch vt := v.(type) {
+	case map[string]any:
+		return CloneMap(vt)
+	case []any:
+		return CloneArray(vt)
+	default:
+		return v
+	}
+}
+
 func SetFields(to map[string]any, from map[string]any) {
 	if &to == &from {
 		return
@@ -1,13 +1,16 @@
 package forjitree
 
 import (
+	"strconv"
 	"sync"
 	"time"
 )
 
+// watcher remembers the values of the nodes changed since the last extraction. The changes are extracted
+// as a diff between the remembered and the current values, so the patches never lose deletions or replacements.
 type watcher struct {
 	watcherId        string
-	tree             *Tree
+	base             *inverseCapture
 	extractTimestamp time.Time
 	mu               sync.Mutex
 }
@@ -15,24 +18,141 @@ type watcher struct {
 func newWatcher(watcherId string) *watcher {
 	w := &watcher{
 		watcherId:        watcherId,
-		tree:             New(),
 		extractTimestamp: time.Now(),
 	}
-	w.tree.created = true
 	return w
 }
 
-func (w *watcher) collectChanges(changes any) {
+// collectChanges adds the values captured before a change, the values captured earlier are kept
+func (w *watcher) collectChanges(c *inverseCapture) {
 	w.mu.Lock()
-	w.tree.Set(changes)
+	w.base = mergeCapture(w.base, c)
 	w.mu.Unlock()
 }
 
-func (w *watcher) extractChanges() any {
+func (w *watcher) getExtractTimestamp() time.Time {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.extractTimestamp
+}
+
+func (w *watcher) extractChanges(root *node) any {
 	w.mu.Lock()
 	w.extractTimestamp = time.Now()
-	result := w.tree.GetValue()
-	w.tree.rootNode = newNode(w.tree, nil, "")
+	var result any
+	if w.base != nil {
+		if patch, changed := root.makePatch(w.base); changed {
+			result = replaceDeleteMarkers(patch)
+		}
+	}
+	w.base = nil
 	w.mu.Unlock()
 	return result
 }
+
+// makePatch makes a patch which turns the captured values into the current ones
+func (n *node) makePatch(c *inverseCapture) (any, bool) {
+	if !c.exists {
+		if n == nil {
+			return nil, false
+		}
+		return n.getValue(), true
+	}
+
+	if n == nil {
+		return Delete, true
+	}
+
+	if c.children != nil {
+		patch := map[string]any{}
+		for k, cc := range c.children {
+			if p, changed := n.getChild(k).makePatch(cc); changed {
+				patch[k] = p
+			}
+		}
+		return patch, len(patch) > 0
+	}
+
+	return diffPatch(c.value, n.getValue())
+}
+
+// mergeCapture combines the captures of two successive changes, the values of the earlier one win.
+// The captures are not modified.
+func mergeCapture(earlier *inverseCapture, later *inverseCapture) *inverseCapture {
+	if earlier == nil {
+		return later
+	}
+	if !earlier.exists || earlier.children == nil || !later.exists {
+		return earlier
+	}
+
+	// The later change replaced the whole node, the keys captured earlier are restored in its value
+	if later.children == nil {
+		value, _ := overlayCapture(later.value, earlier)
+		return &inverseCapture{exists: true, value: value}
+	}
+
+	merged := &inverseCapture{exists: true, children: make(map[string]*inverseCapture, len(earlier.children))}
+	for k, cc := range earlier.children {
+		merged.children[k] = cc
+	}
+	for k, cc := range later.children {
+		merged.children[k] = mergeCapture(earlier.children[k], cc)
+	}
+	return merged
+}
+
+// overlayCapture replaces the parts of the value with the captured ones. Returns false if the captured node didn't exist.
+func overlayCapture(value any, c *inverseCapture) (any, bool) {
+	if !c.exists {
+		return nil, false
+	}
+	if c.children == nil {
+		return c.value, true
+	}
+
+	switch v := value.(type) {
+	case map[string]any:
+		result := make(map[string]any, len(v))
+		for k, v1 := range v {
+			result[k] = v1
+		}
+		for k, cc := range c.children {
+			if v1, ok := overlayCapture(v[k], cc); ok {
+				result[k] = v1
+			} else {
+				delete(result, k)
+			}
+		}
+		return result, true
+	case []any:
+		result := make([]any, len(v))
+		copy(result, v)
+		for k, cc := range c.children {
+			if i, err := strconv.Atoi(k); err == nil && i >= 0 && i < len(result) {
+				if v1, ok := overlayCapture(result[i], cc); ok {
+					result[i] = v1
+				}
+			}
+		}
+		return result, true
+	}
+	return value, true
+}
+
+// replaceDeleteMarkers converts Delete values to their serializable {"$delete": true} form
+func replaceDeleteMarkers(v any) any {
+	switch vt := v.(type) {
+	case map[string]any:
+		for k, v1 := range vt {
+			vt[k] = replaceDeleteMarkers(v1)
+		}
+	case []any:
+		for i, v1 := range vt {
+			vt[i] = replaceDeleteMarkers(v1)
+		}
+	case deleteMarker:
+		return map[string]any{DeleteKeyword: true}
+	}
+	return v
+}